@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// abuseHookTimeout is how long the -abuse-hook command can run.
+const abuseHookTimeout = 10 * time.Second
+
+// rateLimitCount is the number of rate limited requests of a client, since the
+// start of the current -abuse-window.
+type rateLimitCount struct {
+	since time.Time
+	n     int
+}
+
+var (
+	rateLimitCountsMu sync.Mutex
+	// rateLimitCounts are keyed by client IP.
+	rateLimitCounts = make(map[string]*rateLimitCount)
+	// abuseHook are the words of -abuse-hook.
+	abuseHook []string
+)
+
+type abuseEntry struct {
+	Time    string `json:"time"`
+	Event   string `json:"event"`
+	Client  string `json:"client"`
+	Command string `json:"command"`
+	Count   int    `json:"count"`
+	Window  string `json:"window"`
+}
+
+// noteRateLimited records that the request r, for the command with the given
+// name, was rate limited. Once a client is rate limited -abuse-threshold times
+// within -abuse-window, an event is logged, and -abuse-hook is run.
+func noteRateLimited(r *http.Request, name string) {
+	metricRateLimited.Inc()
+	if *flagAbuseThreshold <= 0 {
+		return
+	}
+	ip := clientIP(r)
+	now := time.Now()
+	rateLimitCountsMu.Lock()
+	c, ok := rateLimitCounts[ip]
+	if !ok || now.Sub(c.since) > *flagAbuseWindow {
+		c = &rateLimitCount{since: now}
+		rateLimitCounts[ip] = c
+	}
+	c.n++
+	// Only once per window, so that the hook is not run for each request.
+	exceeded := c.n == *flagAbuseThreshold
+	rateLimitCountsMu.Unlock()
+	if !exceeded {
+		return
+	}
+	logAbuse(abuseEntry{
+		Time:    now.Format(time.RFC3339),
+		Event:   "rate_limit_exceeded",
+		Client:  ip,
+		Command: name,
+		Count:   *flagAbuseThreshold,
+		Window:  flagAbuseWindow.String(),
+	})
+	if len(abuseHook) > 0 {
+		go runAbuseHook(ip, name)
+	}
+}
+
+// logAbuse logs e in the -log-format format, along with the access logs.
+func logAbuse(e abuseEntry) {
+	if *flagLogFormat == "json" {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("could not encode abuse event: %v", err)
+			return
+		}
+		accessLog.Print(string(b))
+		return
+	}
+	accessLog.Printf("time=%s event=%s client=%s command=%s count=%d window=%s",
+		e.Time, e.Event, logfmtValue(e.Client), logfmtValue(e.Command), e.Count, e.Window)
+}
+
+// runAbuseHook runs -abuse-hook about the client with the given IP, rate
+// limited for the command with the given name.
+func runAbuseHook(ip, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abuseHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, abuseHook[0], abuseHook[1:]...)
+	cmd.Env = append(os.Environ(),
+		"HTTPRUNNER_CLIENT="+ip,
+		"HTTPRUNNER_COMMAND="+name,
+		fmt.Sprintf("HTTPRUNNER_COUNT=%d", *flagAbuseThreshold),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("abuse hook failed: %v, %s", err, out)
+	}
+}
+
+// cleanRateLimitCounts forgets the clients whose -abuse-window is over.
+func cleanRateLimitCounts() {
+	rateLimitCountsMu.Lock()
+	defer rateLimitCountsMu.Unlock()
+	for ip, c := range rateLimitCounts {
+		if time.Since(c.since) > *flagAbuseWindow {
+			delete(rateLimitCounts, ip)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessLog writes one line per request, in the -log-format format. Each line
+// has its own time field, so there is no prefix.
+var accessLog = log.New(os.Stderr, "", 0)
+
+// statusWriter is an http.ResponseWriter that records the status of the
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type accessEntry struct {
+	Time       string `json:"time"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr"`
+	Authorized bool   `json:"authorized"`
+	Status     int    `json:"status"`
+	Duration   string `json:"duration"`
+	RequestID  string `json:"request_id"`
+}
+
+// logAccess logs a request that was served with sw.
+func logAccess(r *http.Request, sw *statusWriter, authorized bool, start time.Time) {
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	e := accessEntry{
+		Time:       start.Format(time.RFC3339),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Authorized: authorized,
+		Status:     status,
+		Duration:   time.Since(start).String(),
+		RequestID:  requestID(r.Context()),
+	}
+	if *flagLogFormat == "json" {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("could not encode access log: %v", err)
+			return
+		}
+		accessLog.Print(string(b))
+		return
+	}
+	accessLog.Printf("time=%s method=%s path=%s remote_addr=%s authorized=%v status=%d duration=%s request_id=%s",
+		e.Time, logfmtValue(e.Method), logfmtValue(e.Path), logfmtValue(e.RemoteAddr), e.Authorized, e.Status, e.Duration, logfmtValue(e.RequestID))
+}
+
+// logfmtValue quotes v if needed to be a logfmt value.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\") || strconv.Quote(v) != `"`+v+`"` {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func checkLogFormat() error {
+	switch *flagLogFormat {
+	case "logfmt", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid -log-format %q, must be logfmt or json", *flagLogFormat)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// callbackClient is used to notify the callbacks. It does not follow
+// redirects, as they could lead outside of -callback-hosts.
+var callbackClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// checkCallback returns an error if rawurl is not an HTTP(S) URL on one of the
+// -callback-hosts.
+func checkCallback(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid callback: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid callback %q: not an HTTP URL", rawurl)
+	}
+	for _, host := range strings.Split(*flagCallbackHosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			// The port is part of the allowed host.
+			if strings.EqualFold(u.Host, host) {
+				return nil
+			}
+			continue
+		}
+		if strings.EqualFold(u.Hostname(), strings.Trim(host, "[]")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("callback host %q not allowed", u.Host)
+}
+
+// sendCallback posts the outcome of rn, which has exited, as JSON to its
+// callback URL.
+func sendCallback(rn *run) {
+	body, err := json.Marshal(newResult(rn, rn.output.buf.String(), rn.output.truncated()))
+	if err != nil {
+		logf(rn.ctx, "could not encode result for callback: %v", err)
+		return
+	}
+	resp, err := callbackClient.Post(rn.callback, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logf(rn.ctx, "callback to %v failed: %v", rn.callback, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logf(rn.ctx, "callback to %v failed: %v", rn.callback, resp.Status)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleCancel kills the child started by the request to /run with the given
+// id parameter as its request ID, for the clients that can't just close the
+// connection.
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+	sig, err := parseSignal(r.FormValue("signal"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	childrenMu.RLock()
+	defer childrenMu.RUnlock()
+	// There are few enough children that a map by request ID is not worth
+	// keeping in sync with children.
+	var c *child
+	for _, v := range children {
+		if v.requestID == id {
+			c = v
+			break
+		}
+	}
+	if c == nil {
+		http.Error(w, fmt.Sprintf("no child started by request %q", id), http.StatusNotFound)
+		return
+	}
+	if err := signalChild(c, sig); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't kill child %d: %v", c.pid, err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := fmt.Fprintf(w, "%d, started by request %s, has left for a better world.", c.pid, id); err != nil {
+		logf(r.Context(), "%v", err)
+	}
+}
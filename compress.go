@@ -0,0 +1,57 @@
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// gzipWriter is an http.ResponseWriter that gzips the response body. It must
+// be closed once the response is done.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// maybeGzip returns a gzipWriter wrapping w if the client accepts gzip, and w
+// otherwise. The returned close function must be called once the response is
+// done.
+func maybeGzip(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gw := &gzipWriter{ResponseWriter: w, gz: gzip.NewWriter(w)}
+	return gw, func() {
+		if err := gw.gz.Close(); err != nil {
+			log.Printf("gzip close error: %v", err)
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(enc, ";")[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	return gw.gz.Write(p)
+}
+
+// Flush sends what was written so far to the client.
+func (gw *gzipWriter) Flush() {
+	if err := gw.gz.Flush(); err != nil {
+		log.Printf("gzip flush error: %v", err)
+		return
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// config is the part of the configuration that can be reloaded with SIGHUP.
+type config struct {
+	// commandArgs are the words of each command, keyed by name. The default
+	// command has the empty name.
+	commandArgs map[string][]string
+	rate        time.Duration
+}
+
+var (
+	configMu sync.RWMutex
+	cfg      config
+)
+
+func currentConfig() config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return cfg
+}
+
+// configFile is the format of the -config file. Any field that is set
+// overrides the corresponding flag.
+type configFile struct {
+	// Command is the default command.
+	Command string `json:"command,omitempty"`
+	// Commands are the named commands.
+	Commands map[string]string `json:"commands,omitempty"`
+	// Rate is a duration, as accepted by time.ParseDuration.
+	Rate string `json:"rate,omitempty"`
+}
+
+// loadConfig builds the configuration from the flags, and from the -config
+// file if set.
+func loadConfig() (config, error) {
+	commands := make(map[string]string)
+	for name, command := range flagCommand {
+		commands[name] = command
+	}
+	rate := *flagRate
+	if *flagConfig != "" {
+		data, err := os.ReadFile(*flagConfig)
+		if err != nil {
+			return config{}, err
+		}
+		var cf configFile
+		if err := json.Unmarshal(data, &cf); err != nil {
+			return config{}, fmt.Errorf("invalid config file %v: %v", *flagConfig, err)
+		}
+		if cf.Command != "" {
+			commands[""] = cf.Command
+		}
+		for name, command := range cf.Commands {
+			commands[name] = command
+		}
+		if cf.Rate != "" {
+			if rate, err = time.ParseDuration(cf.Rate); err != nil {
+				return config{}, fmt.Errorf("invalid rate in config file %v: %v", *flagConfig, err)
+			}
+		}
+	}
+	c := config{
+		commandArgs: make(map[string][]string),
+		rate:        rate,
+	}
+	for name, command := range commands {
+		args, err := splitWords(command)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid command %q: %v", command, err)
+		}
+		c.commandArgs[name] = args
+	}
+	if *flagCommandFile != "" {
+		if _, ok := c.commandArgs[""]; ok {
+			return config{}, errors.New("-command-file and a default command can't both be set")
+		}
+		args, err := readCommandFile(*flagCommandFile)
+		if err != nil {
+			return config{}, err
+		}
+		c.commandArgs[""] = args
+	}
+	if len(c.commandArgs) == 0 {
+		return config{}, errors.New("no command to run")
+	}
+	for name, args := range c.commandArgs {
+		if len(args) == 0 {
+			return config{}, fmt.Errorf("empty command %q", name)
+		}
+		if err := checkTemplates(args); err != nil {
+			return config{}, err
+		}
+		if !*flagNoPrecheck {
+			path, err := lookCommand(args[0])
+			if err != nil {
+				return config{}, fmt.Errorf("%v, use -no-precheck if it is created later", err)
+			}
+			if !*flagInsecureCommand {
+				if err := checkCommandFile(path); err != nil {
+					return config{}, refuseCommand(path, err)
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// readCommandFile returns the lines of the file at path, as the words of a
+// command.
+func readCommandFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content := strings.TrimSuffix(string(data), "\n")
+	if content == "" {
+		return nil, fmt.Errorf("command file %v is empty", path)
+	}
+	return strings.Split(content, "\n"), nil
+}
+
+// reloadOnHUP reloads the configuration every time SIGHUP is received. The
+// children started with the previous configuration keep on running.
+func reloadOnHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		c, err := loadConfig()
+		if err != nil {
+			log.Printf("could not reload configuration: %v", err)
+			continue
+		}
+		configMu.Lock()
+		cfg = c
+		configMu.Unlock()
+		log.Print("configuration reloaded")
+	}
+}
+
+// checkCommand returns an error if the program, as found by lookCommand,
+// could be modified by another user, like loadConfig does unless
+// -no-precheck is set.
+func checkCommand(program string) error {
+	path, err := lookCommand(program)
+	if err != nil {
+		return err
+	}
+	if err := checkCommandFile(path); err != nil {
+		return refuseCommand(path, err)
+	}
+	return nil
+}
+
+// refuseCommand returns the error for the program at path, refused because of
+// err, returned by checkCommandFile.
+func refuseCommand(path string, err error) error {
+	return fmt.Errorf("refusing to run %v: %v, use -insecure-command to run it anyway", path, err)
+}
+
+// lookCommand verifies that the program at path can be run from rootdir, and
+// returns its resolved path.
+func lookCommand(path string) (string, error) {
+	if strings.ContainsRune(path, filepath.Separator) && !filepath.IsAbs(path) {
+		// Like exec.Cmd does, relative paths are relative to the command's
+		// directory.
+		path = filepath.Join(rootdir, path)
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return "", fmt.Errorf("command %v not found: %v", path, err)
+	}
+	return resolved, nil
+}
+
+// handleConfig sends the effective configuration as JSON. The secrets are
+// only reported as set or not.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	var env []string
+	for _, kv := range *flagEnv {
+		// The values might be secrets.
+		env = append(env, strings.SplitN(kv, "=", 2)[0])
+	}
+	settings := struct {
+		Commands         map[string][]string `json:"commands"`
+		Rate             string              `json:"rate"`
+		OutputLimit      int64               `json:"output_limit"`
+		Timeout          string              `json:"timeout"`
+		Workdir          string              `json:"workdir"`
+		Env              []string            `json:"env"`
+		AllowArgs        bool                `json:"allow_args"`
+		AllowEnv         string              `json:"allow_env"`
+		AllowStdin       bool                `json:"allow_stdin"`
+		MaxConcurrent    int                 `json:"max_concurrent"`
+		KillOnDisconnect bool                `json:"kill_on_disconnect"`
+		Supervise        bool                `json:"supervise"`
+		History          int                 `json:"history"`
+		Userpass         bool                `json:"userpass"`
+		Token            bool                `json:"token"`
+		ConfirmToken     bool                `json:"confirm_token"`
+	}{
+		Commands:         c.commandArgs,
+		Rate:             c.rate.String(),
+		OutputLimit:      int64(*flagOutputLimit),
+		Timeout:          flagTimeout.String(),
+		Workdir:          rootdir,
+		Env:              env,
+		AllowArgs:        *flagAllowArgs,
+		AllowEnv:         *flagAllowEnv,
+		AllowStdin:       *flagAllowStdin,
+		MaxConcurrent:    *flagMaxConcurrent,
+		KillOnDisconnect: *flagKillOnDisconnect,
+		Supervise:        *flagSupervise,
+		History:          *flagHistory,
+		Userpass:         len(ups) > 0,
+		Token:            *flagToken != "",
+		ConfirmToken:     *flagConfirmToken != "",
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		logf(r.Context(), "error sending config: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// checkCORSOrigin returns an error if -cors-origin allows any origin while
+// requests have to authenticate, as any website could then make
+// authenticated calls, and read their responses.
+func checkCORSOrigin() error {
+	for _, allowed := range strings.Split(*flagCORSOrigin, ",") {
+		if strings.TrimSpace(allowed) == "*" && authRequired() {
+			return errors.New("-cors-origin can not be * with authentication, the allowed origins have to be listed")
+		}
+	}
+	return nil
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header
+// for r, or the empty string if its origin is not one of -cors-origin.
+func allowedOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	// The null origin is the one of sandboxed iframes, and local files,
+	// among others, so it does not identify anyone.
+	if origin == "" || origin == "null" {
+		return ""
+	}
+	for _, allowed := range strings.Split(*flagCORSOrigin, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" && !authRequired() {
+			return "*"
+		}
+		if allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// authRequired reports whether requests have to authenticate.
+func authRequired() bool {
+	return len(ups) > 0 || *flagToken != ""
+}
+
+// setCORSHeaders sets the CORS headers of the response to r, if its origin
+// is allowed. It reports whether r is a preflight request, which then does not
+// need to be served any further.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	origin := allowedOrigin(r)
+	if origin == "" {
+		return preflight
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	// Browsers do not accept a wildcard along with the credentials, so
+	// they are only allowed for the listed origins.
+	if authRequired() && origin != "*" {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+		h.Set("Access-Control-Max-Age", "600")
+		return true
+	}
+	h.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Exit-Code, X-Timed-Out, X-Truncated, Retry-After")
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event is a JSON line of the format=jsonl output.
+type event struct {
+	T      string `json:"t"`
+	Stream string `json:"stream,omitempty"`
+	Data   string `json:"data,omitempty"`
+	// The fields of the last event, once the command has exited.
+	ExitCode  *int `json:"exit_code,omitempty"`
+	TimedOut  bool `json:"timed_out,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// events records the output of a command, as the JSON lines of the
+// format=jsonl output.
+type events struct {
+	out *limitWriter
+
+	mu        sync.Mutex
+	sum       int // number of bytes of output recorded
+	truncated bool
+}
+
+func newEvents() *events {
+	// The limit applies to the output, in add, rather than to the JSON lines,
+	// so that no line is cut.
+	return &events{out: &limitWriter{buf: new(bytes.Buffer)}}
+}
+
+// writer returns a writer whose writes are each recorded as an event of the
+// named stream.
+func (e *events) writer(stream string) io.Writer {
+	return eventWriter{e, stream}
+}
+
+// add records p, written to stream, unless more than -output-limit bytes of
+// output were already recorded.
+func (e *events) add(stream string, p []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.truncated {
+		return
+	}
+	if *flagOutputLimit > 0 && e.sum+len(p) > int(*flagOutputLimit) {
+		e.truncated = true
+		return
+	}
+	e.sum += len(p)
+	e.write(event{Stream: stream, Data: string(p)})
+}
+
+// write records ev as a JSON line. e.mu must be held.
+func (e *events) write(ev event) {
+	ev.T = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	e.out.Write(append(line, '\n'))
+}
+
+type eventWriter struct {
+	e      *events
+	stream string
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.e.add(w.stream, p)
+	return len(p), nil
+}
+
+// streamEvents streams the output of rn as JSON lines, until the command
+// exits, and then sends a last line with its exit code.
+func streamEvents(w http.ResponseWriter, r *http.Request, rn *run, clientGone func()) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	out := throttle(r.Context(), w)
+	if err := streamOutput(r.Context(), out, flusher, rn.events.out, rn.exited); err != nil {
+		clientGone()
+		return
+	}
+	code := exitCode(rn.err)
+	last := event{
+		ExitCode: &code,
+		TimedOut: rn.timedOut(),
+	}
+	rn.events.mu.Lock()
+	last.Truncated = rn.events.truncated
+	rn.events.write(last)
+	rn.events.mu.Unlock()
+	if _, err := io.Copy(out, rn.events.out); err != nil {
+		logf(r.Context(), "response copy error: %v", err)
+	}
+	flusher.Flush()
+	w.Header().Set("X-Exit-Code", fmt.Sprintf("%d", code))
+	if last.TimedOut {
+		w.Header().Set("X-Timed-Out", "true")
+	}
+	if last.Truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// tagWriter writes each line written to it to w, prefixed with tag. An
+// incomplete line is kept until the rest of it is written, or until flush is
+// called.
+type tagWriter struct {
+	tag string
+	w   io.Writer
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (t *tagWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	i := bytes.LastIndexByte(t.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	var lines bytes.Buffer
+	for _, line := range bytes.SplitAfter(t.partial[:i+1], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		lines.WriteString(t.tag)
+		lines.Write(line)
+	}
+	t.partial = append(t.partial[:0], t.partial[i+1:]...)
+	// All the lines are written at once, so that they are not interleaved
+	// with the ones of another tagWriter on the same w.
+	if _, err := t.w.Write(lines.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the incomplete line, if any, terminated by a newline.
+func (t *tagWriter) flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.partial) == 0 {
+		return nil
+	}
+	line := append([]byte(t.tag), t.partial...)
+	t.partial = nil
+	_, err := t.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// grepWriter writes to w only the lines that match re. Incomplete lines are
+// kept until the rest of them is written, or until close is called.
+type grepWriter struct {
+	w       io.Writer
+	re      *regexp.Regexp
+	partial []byte
+}
+
+func (g *grepWriter) Write(p []byte) (int, error) {
+	g.partial = append(g.partial, p...)
+	for {
+		i := bytes.IndexByte(g.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := g.partial[:i+1]
+		if g.re.Match(line[:i]) {
+			if _, err := g.w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+		g.partial = g.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// close writes the last line, if it is incomplete and matches.
+func (g *grepWriter) close() error {
+	defer func() { g.partial = nil }()
+	if len(g.partial) == 0 || !g.re.Match(g.partial) {
+		return nil
+	}
+	_, err := g.w.Write(g.partial)
+	return err
+}
+
+// grepLines returns the lines of p that match re.
+func grepLines(re *regexp.Regexp, p []byte) []byte {
+	var b bytes.Buffer
+	gw := &grepWriter{w: &b, re: re}
+	// Writes to a bytes.Buffer do not fail.
+	gw.Write(p)
+	gw.close()
+	return b.Bytes()
+}
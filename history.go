@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// record is what is kept about a finished run.
+type record struct {
+	Args      []string  `json:"args"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	ExitCode  int       `json:"exit_code"`
+	Truncated bool      `json:"truncated"`
+	Output    string    `json:"output"`
+}
+
+var (
+	historyMu sync.Mutex
+	// history holds the last -history runs, the most recent one last.
+	history []record
+)
+
+// maxExits is the number of exit codes kept for /stats.
+const maxExits = 100
+
+type exit struct {
+	Time time.Time `json:"time"`
+	Code int       `json:"code"`
+}
+
+var (
+	exitsMu sync.Mutex
+	// exits are the last maxExits exit codes, the most recent one last.
+	exits     []exit
+	successes int
+	failures  int
+)
+
+// addExit records the exit code of a run that finished at t.
+func addExit(t time.Time, code int) {
+	exitsMu.Lock()
+	defer exitsMu.Unlock()
+	exits = append(exits, exit{Time: t, Code: code})
+	if len(exits) > maxExits {
+		exits = exits[len(exits)-maxExits:]
+	}
+	if code == 0 {
+		successes++
+	} else {
+		failures++
+	}
+}
+
+// handleStats sends, as JSON, the number of successful and failed runs, and
+// the most recent exit codes.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	exitsMu.Lock()
+	stats := struct {
+		Successes  int               `json:"successes"`
+		Failures   int               `json:"failures"`
+		Exits      []exit            `json:"exits"`
+		Supervisor *supervisorStatus `json:"supervisor,omitempty"`
+	}{
+		Successes:  successes,
+		Failures:   failures,
+		Exits:      append([]exit{}, exits...),
+		Supervisor: supervisorState(),
+	}
+	exitsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		logf(r.Context(), "error sending stats: %v", err)
+	}
+}
+
+func addToHistory(rec record) {
+	if *flagHistory <= 0 {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	history = append(history, rec)
+	if len(history) > *flagHistory {
+		history = history[len(history)-*flagHistory:]
+	}
+}
+
+// handleLast sends the output of the most recent finished run. The exit code
+// and start time are sent as headers, or everything as JSON if asked.
+func handleLast(w http.ResponseWriter, r *http.Request) {
+	historyMu.Lock()
+	if len(history) == 0 {
+		historyMu.Unlock()
+		http.Error(w, "No finished run yet", http.StatusNotFound)
+		return
+	}
+	rec := history[len(history)-1]
+	historyMu.Unlock()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rec); err != nil {
+			logf(r.Context(), "error sending last run: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Exit-Code", fmt.Sprintf("%d", rec.ExitCode))
+	w.Header().Set("X-Start-Time", rec.Start.Format(time.RFC3339))
+	if rec.Truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+	if _, err := io.Copy(w, strings.NewReader(rec.Output)); err != nil {
+		logf(r.Context(), "error sending last run: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// minIdleCheck is the shortest interval between two checks of killWhenIdle.
+const minIdleCheck = 10 * time.Millisecond
+
+// activityWriter records the time of the last write to it.
+type activityWriter struct {
+	last atomic.Int64 // in Unix nanoseconds
+}
+
+func newActivityWriter() *activityWriter {
+	aw := &activityWriter{}
+	aw.last.Store(time.Now().UnixNano())
+	return aw
+}
+
+func (aw *activityWriter) Write(p []byte) (int, error) {
+	aw.last.Store(time.Now().UnixNano())
+	return len(p), nil
+}
+
+// idleFor returns how long ago the last write happened.
+func (aw *activityWriter) idleFor() time.Duration {
+	return time.Since(time.Unix(0, aw.last.Load()))
+}
+
+// killWhenIdle kills rn, running the named program, once it has not written
+// anything to aw for idle, or returns once it has exited.
+func killWhenIdle(rn *run, name string, aw *activityWriter, idle time.Duration) {
+	interval := idle / 4
+	if interval < minIdleCheck {
+		interval = minIdleCheck
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rn.exited:
+			return
+		case <-ticker.C:
+		}
+		if aw.idleFor() < idle {
+			continue
+		}
+		logf(rn.ctx, "%v produced no output for %v, killing it", name, idle)
+		if err := signalGroup(rn.cmd.Process, os.Kill); err != nil {
+			logf(rn.ctx, "couldn't kill child: %v", err)
+		}
+		return
+	}
+}
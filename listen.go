@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mpl/simpletls"
+)
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isDefaultOrEmpty reports whether path, of -cert or -key, is empty or def,
+// the default one.
+func isDefaultOrEmpty(path, def string) bool {
+	return path == "" || path == def
+}
+
+// listen returns a listener on the -socket Unix socket if set. Otherwise, it
+// returns a listener on each of the comma-separated -host addresses.
+func listen() ([]net.Listener, error) {
+	switch *flagNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("invalid -network %q, must be tcp, tcp4, or tcp6", *flagNetwork)
+	}
+	if *flagSocket != "" {
+		l, err := listenUnix(*flagSocket)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	var (
+		listeners []net.Listener
+		errs      []string
+	)
+	for _, host := range strings.Split(*flagHost, ",") {
+		l, err := listenHost(strings.TrimSpace(host))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", host, err))
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(errs) > 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return listeners, nil
+}
+
+// listenHost returns a TLS listener on host using the configured certificate
+// and key, or a plain TCP listener if they are not available.
+func listenHost(host string) (net.Listener, error) {
+	if !*flagTLS {
+		if *flagClientCA != "" {
+			return nil, errors.New("-client-ca requires -tls")
+		}
+		log.Printf("serving plain HTTP on %v", host)
+		return net.Listen(*flagNetwork, host)
+	}
+	if !fileExists(*flagCert) || !fileExists(*flagKey) {
+		// Only a missing default is not an error, as a typo in a path given
+		// by the user would otherwise go unnoticed, with plain HTTP served.
+		if !isDefaultOrEmpty(*flagCert, defaultCert) || !isDefaultOrEmpty(*flagKey, defaultKey) {
+			return nil, fmt.Errorf("TLS certificate or key not found (%q, %q)", *flagCert, *flagKey)
+		}
+		if *flagClientCA != "" {
+			return nil, fmt.Errorf("-client-ca requires a TLS certificate and key, none found (%q, %q)", *flagCert, *flagKey)
+		}
+		log.Printf("WARNING: no TLS certificate and key found (%q, %q), serving plain HTTP", *flagCert, *flagKey)
+		return net.Listen(*flagNetwork, host)
+	}
+	log.Printf("serving HTTPS on %v", host)
+	if *flagCert == defaultCert && *flagKey == defaultKey && *flagNetwork == "tcp" && *flagClientCA == "" && *flagTLSMinVersion == "" {
+		return simpletls.Listen(host)
+	}
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen(*flagNetwork, host, config)
+}
+
+// tlsVersions are the accepted values of -tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS configuration with the -cert and -key key pair,
+// and -tls-min-version, that supports HTTP/2. It requires client certificates with -client-ca.
+func tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(*flagCert, *flagKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS key pair: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Since the listener does TLS itself, http.Server can't add h2 to
+		// the protocols, which has to be done here for HTTP/2 to work.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if *flagTLSMinVersion != "" {
+		v, ok := tlsVersions[*flagTLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid -tls-min-version %q, must be 1.0, 1.1, 1.2, or 1.3", *flagTLSMinVersion)
+		}
+		config.MinVersion = v
+	}
+	if *flagClientCA == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(*flagClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("could not read -client-ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %v", *flagClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// listenUnix listens on the Unix domain socket at path, after removing any
+// stale socket found there. The socket file is removed when the listener is
+// closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("serving plain HTTP on unix socket %v", path)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes, in dir, a self-signed certificate for
+// 127.0.0.1 and its key, and returns their paths, and the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certPath, keyPath string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "httprunner test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert
+}
+
+func TestHTTP2(t *testing.T) {
+	certPath, keyPath, cert := writeSelfSignedCert(t, t.TempDir())
+	defer func(tls bool, network, certPath, keyPath string) {
+		*flagTLS, *flagNetwork, *flagCert, *flagKey = tls, network, certPath, keyPath
+	}(*flagTLS, *flagNetwork, *flagCert, *flagKey)
+	*flagTLS, *flagNetwork, *flagCert, *flagKey = true, "tcp", certPath, keyPath
+	l, err := listenHost("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" {
+		t.Errorf("got protocol %v, want HTTP/2.0", resp.Proto)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("got body %q, want hello", body)
+	}
+}
+
+func TestListenTCP6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	l.Close()
+	defer func(tls bool, network string) { *flagTLS, *flagNetwork = tls, network }(*flagTLS, *flagNetwork)
+	*flagTLS, *flagNetwork = false, "tcp6"
+	l, err = listenHost("[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.IPv6loopback) {
+		t.Errorf("listening on %v, want the IPv6 loopback", l.Addr())
+	}
+	if l, err := listenHost("127.0.0.1:0"); err == nil {
+		l.Close()
+		t.Error("listening on an IPv4 address with -network tcp6")
+	}
+}
+
+func TestListenMissingCert(t *testing.T) {
+	certPath, keyPath, _ := writeSelfSignedCert(t, t.TempDir())
+	defer func(tls bool, network, certPath, keyPath string) {
+		*flagTLS, *flagNetwork, *flagCert, *flagKey = tls, network, certPath, keyPath
+	}(*flagTLS, *flagNetwork, *flagCert, *flagKey)
+	*flagTLS, *flagNetwork = true, "tcp"
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for _, pair := range [][2]string{{missing, keyPath}, {certPath, missing}, {missing, defaultKey}} {
+		*flagCert, *flagKey = pair[0], pair[1]
+		l, err := listenHost("127.0.0.1:0")
+		if err == nil {
+			l.Close()
+			t.Errorf("-cert %v -key %v: no error", pair[0], pair[1])
+		}
+	}
+}
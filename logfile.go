@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	logFileMu sync.Mutex
+	// logFile is the currently open -log-file, if any.
+	logFile *os.File
+)
+
+// openLogFile opens -log-file, and sends the logs, including the access logs,
+// to it, instead of to stderr. The previously open one, if any, is closed.
+func openLogFile() error {
+	f, err := os.OpenFile(*flagLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	log.SetOutput(f)
+	accessLog.SetOutput(f)
+	if logFile != nil {
+		if err := logFile.Close(); err != nil {
+			log.Printf("could not close previous log file: %v", err)
+		}
+	}
+	logFile = f
+	return nil
+}
+
+// reopenLogFileOnHUP opens -log-file again every time SIGHUP is received, so
+// that it can be rotated.
+func reopenLogFileOnHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := openLogFile(); err != nil {
+			log.Printf("could not reopen log file: %v", err)
+			continue
+		}
+		log.Print("log file reopened")
+	}
+}
@@ -2,87 +2,442 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/mpl/basicauth"
-	"github.com/mpl/simpletls"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const (
-	idstring = "http://golang.org/pkg/http/#ListenAndServe"
+var (
+	flagHost             = flag.String("host", "0.0.0.0:8080", "listening port and hostname. It can be a comma-separated list, to listen on several addresses.")
+	flagHelp             = flag.Bool("h", false, "show this help")
+	flagUserpass         = flag.String("userpass", "", "optional username:password protection. It can be a comma-separated list, for several users.")
+	flagCommand          = commandsFlag("command", "The command to run. It is split into words like a shell would, with single and double quotes, and backslash escapes. It can be repeated as name=command to define named commands, run with /run/name.")
+	flagRate             = flag.Duration("rate", time.Second, "To limit the number of processes of a given command created by a given client to no more than one per given duration. Set to 0 for no limit.")
+	flagCert             = flag.String("cert", defaultCert, "path to the TLS certificate. If -cert and -key are empty, or are the default ones and do not exist, plain HTTP is served. Any other file that does not exist is an error.")
+	flagKey              = flag.String("key", defaultKey, "path to the TLS key.")
+	flagAllowArgs        = flag.Bool("allow-args", false, "allow requests to /run to append arguments to the command, with the args parameter. They are split into words like the command.")
+	flagTLS              = flag.Bool("tls", true, "serve over TLS. Set to false when running behind a TLS-terminating reverse proxy.")
+	flagTrustForwarded   = flag.Bool("trust-forwarded", false, "identify clients by the last address of the X-Forwarded-For header, the one added by the proxy, for rate limiting. Only set it when behind a trusted reverse proxy.")
+	flagOutputLimit      = byteSizeFlag("output-limit", 1<<20, "maximum number of bytes of the command's output kept for the response. K, M, and G suffixes are accepted. Set to 0 for no limit.")
+	flagTimeout          = flag.Duration("timeout", 0, "kill the command if it is still running after the given duration. Set to 0 for no timeout. It is also the maximum for the timeout parameter of /run.")
+	flagHealthNoAuth     = flag.Bool("health-no-auth", true, "do not require authentication for /health.")
+	flagEnv              = stringsFlag("env", "KEY=VALUE to add to the environment of the command. It can be repeated.")
+	flagAllowEnv         = flag.String("allow-env", "", "comma-separated list of environment variables that requests to /run can set, with env=KEY=VALUE parameters. Any other variable is ignored.")
+	flagWorkdir          = flag.String("workdir", "", "directory in which the command is run. Defaults to the current directory.")
+	flagAllowStdin       = flag.Bool("allow-stdin", false, "allow the body of requests to /run to be sent to the command's stdin.")
+	flagStdinLimit       = byteSizeFlag("stdin-limit", 1<<20, "maximum number of bytes of a request body sent to the command's stdin. K, M, and G suffixes are accepted.")
+	flagMaxConcurrent    = flag.Int("max-concurrent", 0, "maximum number of children running at the same time. Set to 0 for no limit.")
+	flagKillOnDisconnect = flag.Bool("kill-on-disconnect", false, "kill the command if the client that started it disconnects before the response is done.")
+	flagLogFormat        = flag.String("log-format", "logfmt", "format of the access logs: logfmt or json.")
+	flagMetrics          = flag.Bool("metrics", false, "serve Prometheus metrics on /metrics.")
+	flagIdleTimeout      = flag.Duration("idle-timeout", 200*time.Millisecond, "how long /run waits for more output from the command, before sending the response.")
+	flagResponseWindow   = flag.Duration("response-window", time.Second, "maximum time /run spends gathering output from the command, before sending the response.")
+	flagToken            = flag.String("token", "", "optional bearer token protection. Requests can then authenticate with an \"Authorization: Bearer token\" header, in addition to -userpass.")
+	flagVersionNoAuth    = flag.Bool("version-no-auth", true, "do not require authentication for /version.")
+	flagSocket           = flag.String("socket", "", "path of a Unix domain socket to listen on, instead of -host. Plain HTTP is then served.")
+	flagConfig           = flag.String("config", "", "optional JSON file, with the command, commands, and rate fields, that override -command and -rate. It is reloaded on SIGHUP.")
+	flagHistory          = flag.Int("history", 1, "number of finished runs whose output (up to -output-limit bytes) is kept in memory. The most recent one is served by /last.")
+	flagKillGrace        = flag.Duration("kill-grace", 5*time.Second, "how long /kill waits for a child to exit after sending it a signal other than KILL, before killing it.")
+	flagServerHeader     = flag.String("server-header", "", "value of the Server header sent in responses. None is sent if empty.")
+	flagNoPrecheck       = flag.Bool("no-precheck", false, "do not check at startup that the commands exist, e.g. for commands created at runtime.")
+	flagNetwork          = flag.String("network", "tcp", "network of the -host addresses: tcp, tcp4 (IPv4 only), or tcp6 (IPv6 only). IPv6 addresses are written in brackets, e.g. [::1]:8080.")
+	flagCommandFile      = flag.String("command-file", "", "file defining the default command, with one argument per line, the first one being the program. No quoting or splitting applies.")
+	flagRealm            = flag.String("realm", "httprunner", "realm sent to clients that need to authenticate.")
+	flagAllowCIDR        = stringsFlag("allow-cidr", "only serve the clients whose address (IP or CIDR) is in the given range. It can be repeated.")
+	flagMaxBody          = byteSizeFlag("max-body", 2<<20, "maximum size of a request body. Larger requests are rejected with a 413. K, M, and G suffixes are accepted. Set to 0 for no limit.")
+	flagMaxUptime        = flag.Duration("max-uptime", 0, "if not 0, kill the children and shut down once the server has been running for that long.")
+	flagSupervise        = flag.Bool("supervise", false, "start the default command right away, and restart it whenever it exits, instead of running it on demand. /run, /run/, and /restart are disabled.")
+	flagNoOutputMessage  = flag.String("no-output-message", "Command started but no output yet.", "response sent by /run when the command has not output anything yet.")
+	flagClientCA         = flag.String("client-ca", "", "path to a PEM file of the certificate authorities used to verify client certificates. If set, clients must present a certificate signed by one of them.")
+	flagTLSMinVersion    = flag.String("tls-min-version", "", "minimum TLS version accepted: 1.0, 1.1, 1.2, or 1.3. Defaults to the Go default, currently 1.2.")
+	flagCallbackHosts    = flag.String("callback-hosts", "", "comma-separated list of the hosts (with an optional port) that can be notified, with the callback parameter of /run, when a command exits. The callback parameter is rejected if empty.")
+	flagConfirmToken     = flag.String("confirm-token", "", "if set, requests to /kill, /cancel, and /die must have a confirm parameter with that value.")
+	flagLogDir           = flag.String("log-dir", "", "directory where the whole output, stdout and stderr, of each run is written, to a file named after the logfile parameter of /run, or after the command, and the start time.")
+	flagDrainTimeout     = flag.Duration("drain-timeout", 0, "on shutdown, or with /die, how long to wait for the running children to exit before killing them. No new command is started in the meantime.")
+	flagQueue            = flag.Int("queue", 0, "if not 0, the maximum number of rate limited requests to /run that wait for their turn, instead of being rejected with a 429.")
+	flagQueueWait        = flag.Duration("queue-wait", time.Minute, "with -queue, the longest a request waits for its turn.")
+	flagDisableDie       = flag.Bool("disable-die", false, "do not serve /die.")
+	flagDisableKill      = flag.Bool("disable-kill", false, "do not serve /kill and /cancel.")
+	flagDisableRestart   = flag.Bool("disable-restart", false, "do not serve /restart.")
+	flagNice             = flag.Int("nice", 0, "niceness of the children, from -20 (highest priority) to 19 (lowest). Only on Unix.")
+	flagLimitCPU         = flag.Duration("limit-cpu", 0, "if not 0, the maximum CPU time of each child, rounded up to a second. Only on Linux and macOS.")
+	flagLimitMemory      = byteSizeFlag("limit-memory", 0, "if not 0, the maximum size of the address space of each child. K, M, and G suffixes are accepted. Only on Linux and macOS.")
+	flagLimitFiles       = flag.Int("limit-files", 0, "if not 0, the maximum number of files each child can open. Only on Linux and macOS.")
+	flagArgAllow         = flag.String("arg-allow", "", "a regular expression that each of the arguments of a request (with -allow-args), and each value of a placeholder, must entirely match, or the request is rejected.")
+	flagCORSOrigin       = flag.String("cors-origin", "", "comma-separated list of the origins (such as https://example.com) allowed to call the endpoints from a browser. * allows any origin, but only without authentication. No CORS headers are sent if empty.")
+	flagTruncateTail     = flag.Bool("truncate-tail", false, "when the output of a command exceeds -output-limit, keep its last bytes instead of its first ones.")
+	flagAbuseThreshold   = flag.Int("abuse-threshold", 0, "if not 0, log an event, and run -abuse-hook, when a client is rate limited that many times within -abuse-window.")
+	flagAbuseWindow      = flag.Duration("abuse-window", time.Minute, "the window over which the rate limited requests of a client are counted, for -abuse-threshold.")
+	flagAbuseHook        = flag.String("abuse-hook", "", "with -abuse-threshold, command run when a client exceeds it. It is split into words like -command, and it gets the HTTPRUNNER_CLIENT, HTTPRUNNER_COMMAND, and HTTPRUNNER_COUNT environment variables.")
+	flagDieGrace         = flag.Duration("die-grace", time.Second, "how long /die waits for the killed children to be reaped, before exiting.")
+	flagRunAsUser        = flag.String("run-as-user", "", "name or uid of the user the children run as, usually less privileged than the server, which then has to run as root. Only on Unix.")
+	flagUserpassFile     = flag.String("userpass-file", "", "file with one username:password per line, in addition to -userpass. Empty lines, and lines starting with #, are ignored.")
+	flagInsecureCommand  = flag.Bool("insecure-command", false, "run the commands even if their program, or its directory, is world-writable, or owned by another user than root or the one running the server.")
+	flagLogFile          = flag.String("log-file", "", "file the logs, including the access logs, are appended to, instead of stderr. It is reopened on SIGHUP, e.g. after it has been rotated.")
+	flagOutputRate       = byteSizeFlag("output-rate", 0, "if not 0, the maximum number of bytes per second of output sent in a response to /run or /tail, with bursts of up to a second's worth. K, M, and G suffixes are accepted.")
+	flagIdleKill         = flag.Duration("idle-kill", 0, "if not 0, kill a child that has not output anything, on stdout or stderr, for that long, e.g. because it hung. Unlike -idle-timeout, it applies for the whole run.")
+	flagPlaceholders     = flag.String("placeholders", "", "comma-separated list of the names of the placeholders, such as {{.Name}} for Name, that the words of the commands can contain. Anything else between {{ and }} is kept as is.")
+	flagReadyNoAuth      = flag.Bool("ready-no-auth", true, "do not require authentication for /ready, which reports whether the server is shutting down, and whether the commands can be found.")
+)
+
+// Set with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "devel"
+	commit  = "devel"
 )
 
 var (
-	flagHost     = flag.String("host", "0.0.0.0:8080", "listening port and hostname")
-	flagHelp     = flag.Bool("h", false, "show this help")
-	flagUserpass = flag.String("userpass", "", "optional username:password protection")
-	flagCommand  = flag.String("command", "", "The command to run")
-	flagRate     = flag.Duration("rate", time.Second, "To limit the number of processes created to no more than one per given duration. Set to 0 for no limit.")
+	defaultCert = filepath.Join(os.Getenv("HOME"), "keys", "cert.pem")
+	defaultKey  = filepath.Join(os.Getenv("HOME"), "keys", "key.pem")
 )
 
 var (
-	rootdir, _ = os.Getwd()
-	up         *basicauth.UserPass
+	rootdir, _  = os.Getwd()
+	serverStart = time.Now()
+	// ups are the credentials of -userpass and -userpass-file.
+	ups []*basicauth.UserPass
+	// allowedNets are the networks allowed with -allow-cidr.
+	allowedNets []*net.IPNet
 
 	childrenMu sync.RWMutex
-	children   map[time.Time]*os.Process
+	children   map[int]*child // keyed by pid
+	// draining is set once no more children can be started, on shutdown.
+	draining bool
 
-	// TODO(mpl): rate limit per source ip instead of for all requests?
 	lastRunMu sync.RWMutex
-	lastRun   time.Time
+	lastRun   map[runKey]time.Time
 )
 
+// child is a running command.
+type child struct {
+	pid     int
+	start   time.Time
+	name    string   // of the command, empty for the default one
+	args    []string // the command and its arguments
+	process *os.Process
+	stdout  *limitWriter
+	exited  <-chan struct{} // closed once the command has exited
+	// requestID is the ID of the request that started the command, if any.
+	requestID string
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "\t httprunner \n")
 	flag.PrintDefaults()
-	fmt.Fprint(os.Stderr, "The endpoints are /run, /ls, /kill, and /die.\n")
+	fmt.Fprint(os.Stderr, "The endpoints are /run, /run/<name>, /ls, /tail, /last, /stats, /status, /config, /ui, /cancel, /kill, /die, /restart, /health, /ready, and /version.\n")
 	os.Exit(2)
 }
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+	return wrapHandler(fn, true)
+}
+
+// makePublicHandler is like makeHandler, but the handler does not require
+// authentication.
+func makePublicHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return wrapHandler(fn, false)
+}
+
+func wrapHandler(fn func(http.ResponseWriter, *http.Request), auth bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		r = withRequestID(r)
+		w := &statusWriter{ResponseWriter: rw}
+		w.Header().Set("X-Request-ID", requestID(r.Context()))
+		if !isAllowedAddr(r) {
+			defer logAccess(r, w, false, time.Now())
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if *flagCORSOrigin != "" && setCORSHeaders(w, r) {
+			// Browsers do not send credentials with a preflight request.
+			defer logAccess(r, w, true, time.Now())
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		allowed := !auth || isAllowed(r)
+		defer logAccess(r, w, allowed, time.Now())
 		defer func() {
-			if e, ok := recover().(error); ok {
-				http.Error(w, e.Error(), http.StatusInternalServerError)
+			v := recover()
+			if v == nil {
 				return
 			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logf(r.Context(), "panic serving %v: %v\n%s", r.URL.Path, v, debug.Stack())
+			if w.status != 0 {
+				// Too late for a 500, so the connection is closed instead,
+				// for the client to not mistake what was sent for a
+				// complete response.
+				panic(http.ErrAbortHandler)
+			}
+			// The panic value may reveal internal state, so it is only
+			// logged.
+			http.Error(w, fmt.Sprintf("internal error, request %v", requestID(r.Context())), http.StatusInternalServerError)
 		}()
-		w.Header().Set("Server", idstring)
-		if isAllowed(r) {
+		if *flagServerHeader != "" {
+			w.Header().Set("Server", *flagServerHeader)
+		}
+		if *flagMaxBody > 0 {
+			if r.ContentLength > int64(*flagMaxBody) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(*flagMaxBody))
+		}
+		if allowed {
 			fn(w, r)
 		} else {
-			basicauth.SendUnauthorized(w, r, "httprunner")
+			sendUnauthorized(w, r)
 		}
 	}
 }
 
+// postOnly wraps fn so that it replies with a 405 to any request that is not
+// a POST.
+func postOnly(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
 func isAllowed(r *http.Request) bool {
-	if *flagUserpass == "" {
+	if !authRequired() {
+		return true
+	}
+	if *flagToken != "" && hasToken(r) {
 		return true
 	}
-	return up.IsAllowed(r)
+	for _, up := range ups {
+		if up.IsAllowed(r) {
+			return true
+		}
+	}
+	return false
 }
 
-func initUserPass() {
-	if *flagUserpass == "" {
+// hasToken reports whether r carries the bearer token set with -token.
+func hasToken(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(*flagToken)) == 1
+}
+
+// sendUnauthorized replies with a 401, and a challenge for the configured
+// authentication method.
+func sendUnauthorized(w http.ResponseWriter, r *http.Request) {
+	if len(ups) > 0 {
+		basicauth.SendUnauthorized(w, r, *flagRealm)
 		return
 	}
-	var err error
-	up, err = basicauth.New(*flagUserpass)
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", *flagRealm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// confirmed wraps fn so that it is only run if the request has a confirm
+// parameter matching -confirm-token, if set.
+func confirmed(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *flagConfirmToken != "" && subtle.ConstantTimeCompare([]byte(r.FormValue("confirm")), []byte(*flagConfirmToken)) != 1 {
+			http.Error(w, "missing or invalid confirm parameter", http.StatusBadRequest)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// isAllowedAddr reports whether r comes from a network allowed with
+// -allow-cidr.
+func isAllowedAddr(r *http.Request) bool {
+	if len(allowedNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Fatal(err)
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
+
+func initAllowedNets() {
+	for _, cidr := range *flagAllowCIDR {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("invalid -allow-cidr: %v", err)
+		}
+		allowedNets = append(allowedNets, n)
+	}
+}
+
+func initUserPass() {
+	var creds []string
+	if *flagUserpass != "" {
+		creds = strings.Split(*flagUserpass, ",")
+	}
+	if *flagUserpassFile != "" {
+		data, err := os.ReadFile(*flagUserpassFile)
+		if err != nil {
+			log.Fatalf("could not read -userpass-file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			creds = append(creds, line)
+		}
+	}
+	for _, cred := range creds {
+		up, err := basicauth.New(cred)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ups = append(ups, up)
+	}
+}
+
+// commands is a flag.Value for the commands that can be run, keyed by name.
+// The default command, run by /run, has the empty name.
+type commands map[string]string
+
+func commandsFlag(name, usage string) commands {
+	c := make(commands)
+	flag.Var(c, name, usage)
+	return c
+}
+
+func (c commands) String() string {
+	var defs []string
+	for name, command := range c {
+		if name == "" {
+			defs = append(defs, command)
+			continue
+		}
+		defs = append(defs, name+"="+command)
+	}
+	sort.Strings(defs)
+	return strings.Join(defs, ", ")
+}
+
+// Set adds a command definition, of the form name=command. If the part before
+// the first '=' contains a whitespace, the whole value is the default command.
+func (c commands) Set(s string) error {
+	name, command := "", s
+	if i := strings.Index(s, "="); i > 0 && !strings.ContainsAny(s[:i], " \t") {
+		name, command = s[:i], s[i+1:]
+	}
+	if _, ok := c[name]; ok {
+		if name == "" {
+			return errors.New("default command defined twice")
+		}
+		return fmt.Errorf("command %q defined twice", name)
+	}
+	c[name] = command
+	return nil
+}
+
+// stringList is a flag.Value for a flag that can be repeated.
+type stringList []string
+
+func stringsFlag(name, usage string) *stringList {
+	var l stringList
+	flag.Var(&l, name, usage)
+	return &l
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// byteSize is a flag.Value for a number of bytes, with an optional K, M, or G
+// suffix (as powers of 1024).
+type byteSize int64
+
+func byteSizeFlag(name string, value byteSize, usage string) *byteSize {
+	b := value
+	flag.Var(&b, name, usage)
+	return &b
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	num, mult := s, int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
 }
 
 // TODO(mpl): have a look at https://github.com/cespare/window
@@ -90,190 +445,1032 @@ func initUserPass() {
 
 type limitWriter struct {
 	deadline time.Time
-	limit    int
-	sum      int
+	limit    int // 0 means no limit
+	// keepTail is whether the oldest unread bytes are discarded, instead of
+	// the new ones, when the limit is reached.
+	keepTail bool
 
-	bufMu sync.Mutex
+	bufMu sync.Mutex // protects buf, sum, and tails
 	buf   *bytes.Buffer
+	sum   int
+	// tails get a copy of everything written, up to their own limit.
+	tails []*limitWriter
 
 	discardingMu sync.RWMutex
 	discarding   bool
 }
 
-func (lw limitWriter) Write(p []byte) (n int, err error) {
-	lw.discardingMu.RLock()
-	if lw.discarding {
-		lw.discardingMu.RUnlock()
+func (lw *limitWriter) Write(p []byte) (n int, err error) {
+	lw.bufMu.Lock()
+	defer lw.bufMu.Unlock()
+	for _, t := range lw.tails {
+		t.Write(p)
+	}
+	if lw.keepTail && lw.limit > 0 {
+		return lw.writeTail(p)
+	}
+	if lw.truncated() {
 		return ioutil.Discard.Write(p)
 	}
-	lw.discardingMu.RUnlock()
-	lw.bufMu.Lock()
-	n, err = lw.buf.Write(p)
-	lw.bufMu.Unlock()
-	lw.sum += n
-	if lw.sum > lw.limit {
+	kept := p
+	if lw.limit > 0 && lw.sum+len(p) > lw.limit {
+		kept = p[:lw.limit-lw.sum]
 		lw.discardingMu.Lock()
 		lw.discarding = true
 		lw.discardingMu.Unlock()
 	}
-	return
+	n, err = lw.buf.Write(kept)
+	lw.sum += n
+	if err != nil {
+		return n, err
+	}
+	// The discarded part counts as written.
+	return len(p), nil
 }
 
-func (lw limitWriter) Read(p []byte) (n int, err error) {
-	lw.discardingMu.RLock()
-	if lw.discarding {
-		lw.discardingMu.RUnlock()
-		return 0, io.EOF
+// writeTail writes p, and then discards the oldest unread bytes in excess of
+// the limit. bufMu must be held.
+func (lw *limitWriter) writeTail(p []byte) (int, error) {
+	kept := p
+	if len(kept) > lw.limit {
+		kept = kept[len(kept)-lw.limit:]
+	}
+	if _, err := lw.buf.Write(kept); err != nil {
+		return 0, err
 	}
-	lw.discardingMu.RUnlock()
+	if excess := lw.buf.Len() - lw.limit; excess > 0 || len(kept) < len(p) {
+		lw.buf.Next(excess)
+		lw.discardingMu.Lock()
+		lw.discarding = true
+		lw.discardingMu.Unlock()
+	}
+	return len(p), nil
+}
+
+// Read reads from what was kept of the output. It returns io.EOF when it has
+// caught up with the writes, even if more are to come.
+func (lw *limitWriter) Read(p []byte) (n int, err error) {
 	lw.bufMu.Lock()
 	defer lw.bufMu.Unlock()
 	return lw.buf.Read(p)
 }
 
-func killChildren() {
+// tail returns a limitWriter that starts with what has not been read yet from
+// lw, and then gets a copy of all the writes to lw, until untail is called.
+func (lw *limitWriter) tail() *limitWriter {
+	lw.bufMu.Lock()
+	defer lw.bufMu.Unlock()
+	t := &limitWriter{
+		limit:    lw.limit,
+		keepTail: lw.keepTail,
+		buf:      new(bytes.Buffer),
+	}
+	t.Write(lw.buf.Bytes())
+	lw.tails = append(lw.tails, t)
+	return t
+}
+
+// untail stops copying the writes to lw to t.
+func (lw *limitWriter) untail(t *limitWriter) {
+	lw.bufMu.Lock()
+	defer lw.bufMu.Unlock()
+	for i, v := range lw.tails {
+		if v == t {
+			lw.tails = append(lw.tails[:i], lw.tails[i+1:]...)
+			return
+		}
+	}
+}
+
+// truncated reports whether lw started discarding its input.
+func (lw *limitWriter) truncated() bool {
+	lw.discardingMu.RLock()
+	defer lw.discardingMu.RUnlock()
+	return lw.discarding
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// countWriter counts the bytes and lines written to w.
+type countWriter struct {
+	w     io.Writer
+	bytes int
+	lines int
+	// partial is whether the last line written is not terminated yet.
+	partial bool
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.bytes += n
+		cw.lines += bytes.Count(p[:n], []byte("\n"))
+		cw.partial = p[n-1] != '\n'
+	}
+	return n, err
+}
+
+// lineCount returns the number of lines written, including an unterminated
+// last one.
+func (cw *countWriter) lineCount() int {
+	if cw.partial {
+		return cw.lines + 1
+	}
+	return cw.lines
+}
+
+// signals are the signals that can be sent with /kill.
+var signals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal returns the signal with the given name, with or without the SIG
+// prefix. It defaults to SIGTERM if name is empty.
+func parseSignal(name string) (os.Signal, error) {
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// signalChild sends sig to c. Unless sig is KILL, c is killed if it is still
+// running after -kill-grace. childrenMu must be held.
+func signalChild(c *child, sig os.Signal) error {
+	p := c.process
+	if sig == syscall.SIGKILL {
+		if err := signalGroup(p, os.Kill); err != nil {
+			return err
+		}
+		metricKilled.Inc()
+		return nil
+	}
+	if err := signalGroup(p, sig); err != nil {
+		// Not all platforms support signals other than KILL.
+		log.Printf("couldn't send %v to %d, killing it instead: %v", sig, p.Pid, err)
+		return signalChild(c, syscall.SIGKILL)
+	}
+	metricKilled.Inc()
+	go func() {
+		time.Sleep(*flagKillGrace)
+		childrenMu.RLock()
+		running := children[c.pid] == c
+		childrenMu.RUnlock()
+		if !running {
+			return
+		}
+		log.Printf("%d still running %v after %v, killing it", p.Pid, *flagKillGrace, sig)
+		if err := signalGroup(p, os.Kill); err != nil {
+			log.Printf("couldn't kill child: %v", err)
+		}
+	}()
+	return nil
+}
+
+// killChildren sends sig to all the children.
+func killChildren(sig os.Signal) {
 	childrenMu.Lock()
 	defer childrenMu.Unlock()
-	for _, v := range children {
-		if err := v.Kill(); err != nil {
+	for _, c := range children {
+		if err := signalChild(c, sig); err != nil {
 			log.Printf("couldn't kill child: %v", err)
 		}
 	}
-	children = make(map[time.Time]*os.Process)
+	if sig == syscall.SIGKILL {
+		// No need to wait for them to be reaped to forget about them.
+		children = make(map[int]*child)
+	}
+}
+
+// drainChildren prevents any new child from being started, and waits for up to
+// timeout for the running children to exit, before killing the remaining
+// ones. It returns how many exited by themselves, and how many were killed.
+func drainChildren(timeout time.Duration) (drained, killed int) {
+	childrenMu.Lock()
+	draining = true
+	childrenMu.Unlock()
+	running := runningChildren()
+	deadline := time.After(timeout)
+wait:
+	for _, c := range running {
+		select {
+		case <-c.exited:
+		case <-deadline:
+			break wait
+		}
+	}
+	childrenMu.RLock()
+	killed = len(children)
+	childrenMu.RUnlock()
+	drained = len(running) - killed
+	killChildren(syscall.SIGKILL)
+	return drained, killed
+}
+
+// runningChildren returns the children currently running.
+func runningChildren() []*child {
+	childrenMu.RLock()
+	defer childrenMu.RUnlock()
+	var running []*child
+	for _, c := range children {
+		running = append(running, c)
+	}
+	return running
+}
+
+// waitChildren waits for running to be reaped, for at most timeout. It
+// reports whether they were.
+func waitChildren(running []*child, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, c := range running {
+		select {
+		case <-c.exited:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// killChild sends sig to the child with the given pid, and reports whether it
+// was found. The child is removed from children once it has been waited for.
+func killChild(pid int, sig os.Signal) (bool, error) {
+	childrenMu.RLock()
+	defer childrenMu.RUnlock()
+	c, ok := children[pid]
+	if !ok {
+		return false, nil
+	}
+	return true, signalChild(c, sig)
 }
 
 func handleKillAll(w http.ResponseWriter, r *http.Request) {
-	killChildren()
+	sig, err := parseSignal(r.FormValue("signal"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pidStr := r.FormValue("pid"); pidStr != "" {
+		handleKill(w, r, pidStr, sig)
+		return
+	}
+	killChildren(sig)
 	if _, err := io.Copy(w, strings.NewReader("They have left for a better world.")); err != nil {
-		log.Print(err)
+		logf(r.Context(), "%v", err)
 	}
 }
 
+func handleKill(w http.ResponseWriter, r *http.Request, pidStr string, sig os.Signal) {
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pid %q", pidStr), http.StatusBadRequest)
+		return
+	}
+	found, err := killChild(pid, sig)
+	if !found {
+		http.Error(w, fmt.Sprintf("no child with pid %d", pid), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't kill child %d: %v", pid, err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := fmt.Fprintf(w, "%d has left for a better world.", pid); err != nil {
+		logf(r.Context(), "%v", err)
+	}
+}
+
+func handleRestart(w http.ResponseWriter, r *http.Request) {
+	args, ok := currentConfig().commandArgs[""]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(args) == 0 {
+		http.Error(w, "no command configured", http.StatusInternalServerError)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if err := r.ParseForm(); errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Like for /run, the placeholders are filled from the parameters.
+	if err := checkPlaceholderValues(args, formParam(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := expandArgs(args, formParam(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rateLimited(w, r, "") {
+		return
+	}
+	killChildren(syscall.SIGKILL)
+	startCommand(w, r, &runOptions{
+		args:      args,
+		env:       *flagEnv,
+		timeout:   *flagTimeout,
+		requestID: requestID(r.Context()),
+	})
+}
+
 func handleDie(w http.ResponseWriter, r *http.Request) {
-	killChildren()
+	stopSupervising()
+	// Killing them forgets about them, so they have to be listed before.
+	running := runningChildren()
+	drained, killed := drainChildren(*flagDrainTimeout)
 	sayonara := "The sweet embrace of death, finally."
-	if _, err := io.Copy(w, strings.NewReader(sayonara)); err != nil {
-		log.Print(err)
+	if _, err := fmt.Fprintf(w, "%s (%d drained, %d killed)", sayonara, drained, killed); err != nil {
+		logf(r.Context(), "%v", err)
+	}
+	// The response would otherwise still be buffered when exiting.
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
 	}
 	log.Print(sayonara)
-	time.Sleep(time.Second)
+	if !waitChildren(running, *flagDieGrace) {
+		log.Printf("children still not reaped after %v", *flagDieGrace)
+	}
 	os.Exit(0)
 }
 
-type times []time.Time
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	childrenMu.RLock()
+	nchildren := len(children)
+	childrenMu.RUnlock()
+	health := struct {
+		Uptime   string `json:"uptime"`
+		Children int    `json:"children"`
+	}{
+		Uptime:   time.Since(serverStart).String(),
+		Children: nchildren,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		logf(r.Context(), "error sending health: %v", err)
+	}
+}
+
+// ready is set once the server is fully started.
+var ready atomic.Bool
+
+// handleReady replies with a 200 once the server is started and the commands
+// can be run, and with a 503 otherwise, or if the server is shutting down.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	childrenMu.RLock()
+	shuttingDown := draining
+	childrenMu.RUnlock()
+	if shuttingDown {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if *flagNoPrecheck {
+		// The commands were not checked at startup.
+		for _, args := range currentConfig().commandArgs {
+			if _, err := lookCommand(args[0]); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+	if _, err := io.WriteString(w, "ready"); err != nil {
+		logf(r.Context(), "error sending readiness: %v", err)
+	}
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	v := struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		GoVersion string `json:"go_version"`
+	}{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logf(r.Context(), "error sending version: %v", err)
+	}
+}
+
+// byStart sorts children by start time.
+type byStart []*child
 
-func (t times) Len() int           { return len(t) }
-func (t times) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t times) Less(i, j int) bool { return t[i].Before(t[j]) }
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].start.Before(s[j].start) }
 
 func handleList(w http.ResponseWriter, r *http.Request) {
 	childrenMu.RLock()
 	defer childrenMu.RUnlock()
-	var t times
-	for k, _ := range children {
-		t = append(t, k)
+	var list byStart
+	for _, c := range children {
+		list = append(list, c)
+	}
+	sort.Sort(list)
+	if wantsJSON(r) {
+		listJSON(w, r, list)
+		return
 	}
-	sort.Sort(t)
 	var out bytes.Buffer
-	for _, pt := range t {
-		if _, err := out.WriteString(fmt.Sprintf("%s : %d\n", pt.Format(time.RFC3339), children[pt].Pid)); err != nil {
+	for _, c := range list {
+		if _, err := out.WriteString(fmt.Sprintf("%s : %d : %v\n", c.start.Format(time.RFC3339), c.pid, time.Since(c.start).Round(time.Second))); err != nil {
 			http.Error(w, "can't print children list", http.StatusInternalServerError)
 			return
 		}
 	}
 	if _, err := io.Copy(w, &out); err != nil {
-		log.Printf("error listing children: %v", err)
+		logf(r.Context(), "error listing children: %v", err)
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response, with the
+// format parameter or the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.FormValue("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+type childInfo struct {
+	Pid        int    `json:"pid"`
+	StartTime  string `json:"start_time"`
+	RunningFor string `json:"running_for"`
+}
+
+// listJSON sends the children in list.
+func listJSON(w http.ResponseWriter, r *http.Request, list []*child) {
+	infos := []childInfo{}
+	for _, c := range list {
+		infos = append(infos, childInfo{
+			Pid:        c.pid,
+			StartTime:  c.start.Format(time.RFC3339),
+			RunningFor: time.Since(c.start).String(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		logf(r.Context(), "error listing children: %v", err)
+	}
+}
+
+// runKey identifies, for the rate limiting, the runs of a command by a client.
+type runKey struct {
+	command string // the name of the command, empty for the default one
+	client  string // the IP address of the client
+}
+
+// clientIP returns the IP address of the client that sent r.
+func clientIP(r *http.Request) string {
+	if *flagTrustForwarded {
+		// The trusted proxy appends the address it got the request from, so
+		// only the last entry is not under the control of the client.
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// cleanLastRun periodically forgets about the clients that are not rate
+// limited anymore.
+func cleanLastRun() {
+	interval := time.Minute
+	if rate := currentConfig().rate; rate > interval {
+		interval = rate
+	}
+	for range time.Tick(interval) {
+		rate := currentConfig().rate
+		lastRunMu.Lock()
+		for k, t := range lastRun {
+			if time.Now().After(t.Add(rate)) {
+				delete(lastRun, k)
+			}
+		}
+		lastRunMu.Unlock()
+		cleanRateLimitCounts()
 	}
 }
 
 func handleCommand(w http.ResponseWriter, r *http.Request) {
-	if *flagRate != 0 {
-		lastRunMu.RLock()
-		if time.Now().Before(lastRun.Add(*flagRate)) {
-			http.Error(w, "Command process creation is rate limited", http.StatusTooManyRequests)
-			lastRunMu.RUnlock()
+	args, ok := currentConfig().commandArgs[""]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	runCommand(w, r, "", args)
+}
+
+func handleNamedCommand(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/run/")
+	args, ok := currentConfig().commandArgs[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	runCommand(w, r, name, args)
+}
+
+// sendDryRun replies with what would be run, as JSON. Env only contains the
+// variables added to the environment of httprunner.
+func sendDryRun(w http.ResponseWriter, r *http.Request, opts *runOptions) {
+	dry := struct {
+		Command string   `json:"command"`
+		Args    []string `json:"args"`
+		Dir     string   `json:"dir"`
+		Env     []string `json:"env"`
+	}{
+		Command: opts.args[0],
+		Args:    opts.args[1:],
+		Dir:     rootdir,
+		Env:     opts.env,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dry); err != nil {
+		logf(r.Context(), "error sending dry run: %v", err)
+	}
+}
+
+// runCommand runs the command with the given name, and args words.
+func runCommand(w http.ResponseWriter, r *http.Request, name string, args []string) {
+	// loadConfig does not allow empty commands, but better safe than sorry.
+	if len(args) == 0 {
+		http.Error(w, "no command configured", http.StatusInternalServerError)
+		return
+	}
+	opts, err := parseRun(r, args)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
 			return
 		}
-		lastRunMu.RUnlock()
-	}
-	// TODO(mpl): be less lazy about the doubled spaces, and probably other things.
-	args := strings.Fields(*flagCommand)
-	cmd := exec.Command(args[0], args[1:]...)
-	var buf, berr bytes.Buffer
-	lw := limitWriter{
-		limit: 1 << 20,
-		buf:   &buf,
-	}
-	stdout := io.MultiWriter(os.Stdout, lw)
-	cmd.Stdout = stdout
-	cmd.Stderr = &berr
-	if err := cmd.Start(); err != nil {
-		log.Printf("%v failed to start: %v, %v", args[0], err, berr.String())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("dry") != "" {
+		sendDryRun(w, r, opts)
+		return
+	}
+	opts.name = name
+	if *flagQueue > 0 {
+		if !waitTurn(w, r, name) {
+			return
+		}
+	} else if rateLimited(w, r, name) {
+		return
+	}
+	startCommand(w, r, opts)
+}
+
+// untilNextRun returns how long the client with the given IP has to wait
+// before running the named command, 0 if it doesn't.
+func untilNextRun(name, ip string) time.Duration {
+	rate := currentConfig().rate
+	lastRunMu.RLock()
+	defer lastRunMu.RUnlock()
+	wait := time.Until(lastRun[runKey{name, ip}].Add(rate))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// handleStatus sends, as JSON, how long the client has to wait before it can
+// run each command, in seconds.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	ip := clientIP(r)
+	waits := make(map[string]float64)
+	for name := range c.commandArgs {
+		waits[name] = untilNextRun(name, ip).Seconds()
+	}
+	status := struct {
+		Rate string             `json:"rate"`
+		Wait map[string]float64 `json:"wait"`
+	}{
+		Rate: c.rate.String(),
+		Wait: waits,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logf(r.Context(), "error sending status: %v", err)
+	}
+}
+
+// setRetryAfter sets the Retry-After header to wait, rounded up to a second.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// rateLimited reports whether the client that sent r is not allowed to run the
+// named command yet, in which case it has already replied with a 429. Each
+// command is rate limited independently of the others.
+func rateLimited(w http.ResponseWriter, r *http.Request, name string) bool {
+	if wait := untilNextRun(name, clientIP(r)); wait > 0 {
+		setRetryAfter(w, wait)
+		noteRateLimited(r, name)
+		http.Error(w, "Command process creation is rate limited", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// startCommand runs the command described by opts, and replies with its
+// output.
+func startCommand(w http.ResponseWriter, r *http.Request, opts *runOptions) {
+	args := opts.args
+	rn, err := spawn(opts)
+	if err == errTooManyChildren {
+		http.Error(w, "Too many commands already running", http.StatusServiceUnavailable)
+		return
+	}
+	if err == errDraining {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v failed to start: %v", args[0], err), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Started %v with pid %v", args[0], cmd.Process.Pid)
-	startTime := time.Now()
-	childrenMu.Lock()
-	children[startTime] = cmd.Process
-	childrenMu.Unlock()
 	lastRunMu.Lock()
-	lastRun = time.Now()
+	lastRun[runKey{opts.name, clientIP(r)}] = time.Now()
 	lastRunMu.Unlock()
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("%v failed: %v, %v", args[0], err, berr.String())
+	if r.FormValue("async") != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(struct {
+			Pid int `json:"pid"`
+		}{rn.cmd.Process.Pid}); err != nil {
+			logf(r.Context(), "error sending pid: %v", err)
 		}
-		childrenMu.Lock()
-		delete(children, startTime)
-		childrenMu.Unlock()
-	}()
-	var bufout bytes.Buffer
+		return
+	}
+	w, closeGzip := maybeGzip(w, r)
+	defer closeGzip()
+	lw := rn.stdout
+	if rn.framed != nil {
+		lw = rn.framed
+	}
+	// bufout gathers the output, unless it is streamed. With -truncate-tail,
+	// lw only limits what has not been read from it yet, so bufout has to be
+	// limited too.
+	bufout := &limitWriter{
+		limit:    lw.limit,
+		keepTail: lw.keepTail,
+		buf:      new(bytes.Buffer),
+	}
+	truncated := func() bool {
+		return lw.truncated() || bufout.truncated()
+	}
+	// The header is usually sent before the command is done, so the exit code
+	// is sent as a trailer.
+	w.Header().Set("Trailer", "X-Exit-Code, X-Timed-Out, X-Truncated, X-Output-Bytes, X-Output-Lines")
+	// sent counts the output of the command sent in the response.
+	sent := &countWriter{w: throttle(r.Context(), w)}
+	asJSON := r.FormValue("format") == "json"
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		setContentHeaders(w, r, opts.binary)
+	}
+	// finishResponse appends the notes about the run to the response, and sets
+	// the trailers.
+	finishResponse := func() {
+		code := -1
+		done := rn.done()
+		if done {
+			code = exitCode(rn.err)
+		}
+		w.Header().Set("X-Exit-Code", fmt.Sprintf("%d", code))
+		timedOut := done && rn.timedOut()
+		if timedOut {
+			w.Header().Set("X-Timed-Out", "true")
+		}
+		if truncated() {
+			w.Header().Set("X-Truncated", "true")
+		}
+		w.Header().Set("X-Output-Bytes", strconv.Itoa(sent.bytes))
+		w.Header().Set("X-Output-Lines", strconv.Itoa(sent.lineCount()))
+		if opts.binary {
+			// Nothing but the output goes in the response.
+			return
+		}
+		if truncated() {
+			note := "\n[output truncated at %d bytes]\n"
+			if lw.keepTail {
+				note = "\n[output truncated, only its last %d bytes were kept]\n"
+			}
+			if _, err := fmt.Fprintf(w, note, lw.limit); err != nil {
+				logf(r.Context(), "response copy error: %v", err)
+			}
+		}
+		if timedOut {
+			if _, err := fmt.Fprintf(w, "\n[command timed out after %v]\n", rn.timeout); err != nil {
+				logf(r.Context(), "response copy error: %v", err)
+			}
+		}
+		if rn.framed != nil || r.FormValue("stderr") == "" && (!done || code == 0) {
+			// With framed, stderr is already in the output.
+			return
+		}
+		if stderr := rn.stderr.String(); stderr != "" {
+			if _, err := fmt.Fprintf(w, "\n[stderr]\n%s", stderr); err != nil {
+				logf(r.Context(), "response copy error: %v", err)
+			}
+		}
+	}
+	clientGone := func() {
+		logf(r.Context(), "client for %v went away, wrapping up.", args[0])
+		if !*flagKillOnDisconnect {
+			return
+		}
+		if err := signalGroup(rn.cmd.Process, os.Kill); err != nil {
+			logf(r.Context(), "couldn't kill child: %v", err)
+		}
+	}
+	markerSent := asJSON || opts.binary || r.FormValue("header") == ""
+	// sendMarker writes, if asked and if not done yet, a line about the run
+	// before the command's output.
+	sendMarker := func() {
+		if markerSent {
+			return
+		}
+		markerSent = true
+		if _, err := fmt.Fprintf(w, "[pid %d, started %s: %s]\n", rn.cmd.Process.Pid, rn.start.Format(time.RFC3339), args[0]); err != nil {
+			logf(r.Context(), "response copy error: %v", err)
+		}
+	}
+	if opts.jsonl {
+		streamEvents(w, r, rn, clientGone)
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok && !asJSON && r.FormValue("stream") != "" {
+		w.WriteHeader(http.StatusOK)
+		sendMarker()
+		output := io.Writer(sent)
+		var gw *grepWriter
+		if opts.grep != nil {
+			gw = &grepWriter{w: sent, re: opts.grep}
+			output = gw
+		}
+		if err := streamOutput(r.Context(), output, flusher, lw, rn.exited); err != nil {
+			clientGone()
+			return
+		}
+		if gw != nil {
+			if err := gw.close(); err != nil {
+				logf(r.Context(), "response copy error: %v", err)
+			}
+		}
+		finishResponse()
+		return
+	}
 	sendResponse := func(b *bytes.Buffer) {
+		if opts.grep != nil {
+			b = bytes.NewBuffer(grepLines(opts.grep, b.Bytes()))
+		}
+		if asJSON {
+			sendResult(w, r, rn, b, truncated())
+			return
+		}
+		sendMarker()
 		var response io.Reader
-		if b.Len() > 0 {
+		if b.Len() > 0 || opts.binary {
 			response = b
 		} else {
-			response = strings.NewReader("Command started but no output yet.")
+			response = strings.NewReader(*flagNoOutputMessage)
+		}
+		out := io.Writer(w)
+		if response == b {
+			out = sent
 		}
-		if _, err := io.Copy(w, response); err != nil {
-			log.Printf("response copy error: %v", err)
+		if _, err := io.Copy(out, response); err != nil {
+			logf(r.Context(), "response copy error: %v", err)
 		}
+		finishResponse()
+	}
+	if r.FormValue("wait") != "" {
+		select {
+		case <-rn.exited:
+		case <-r.Context().Done():
+			clientGone()
+			return
+		}
+		if _, err := io.Copy(bufout, lw); err != nil {
+			logf(r.Context(), "output copy error: %v", err)
+		}
+		sendResponse(bufout.buf)
+		return
 	}
 	var seenData bool
-	// TODO(mpl): test if we could relax both these times now that we're sending the header asap.
-	maxIdle := 200 * time.Millisecond
-	t := time.After(1 * time.Second)
+	maxIdle := *flagIdleTimeout
+	t := time.After(*flagResponseWindow)
 	lastDataTime := time.Now()
 	for {
 		select {
 		case <-t:
-			sendResponse(&bufout)
+			sendResponse(bufout.buf)
+			return
+		case <-r.Context().Done():
+			clientGone()
 			return
 		default:
 		}
-		n, err := io.Copy(&bufout, lw)
+		n, err := io.Copy(bufout, lw)
 		if err != nil {
-			log.Printf("output copy error: %v", err)
+			logf(r.Context(), "output copy error: %v", err)
 			break
 		}
 		if n > 0 {
 			if !seenData {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 				w.WriteHeader(http.StatusOK)
+				sendMarker()
 				seenData = true
 			}
 			lastDataTime = time.Now()
 		} else {
 			if lastDataTime.Add(maxIdle).Before(time.Now()) {
-				log.Printf("no output for more than %v, wrapping up.", maxIdle)
+				logf(r.Context(), "no output for more than %v, wrapping up.", maxIdle)
 				break
 			}
 		}
 	}
-	sendResponse(&bufout)
+	sendResponse(bufout.buf)
+}
+
+// result is the outcome of a run, as sent with format=json.
+type result struct {
+	// Status is "started" if the command is still running, "exited"
+	// otherwise.
+	Status    string `json:"status"`
+	Pid       int    `json:"pid"`
+	Started   string `json:"started"`
+	Duration  string `json:"duration"`
+	ExitCode  int    `json:"exit_code"`
+	TimedOut  bool   `json:"timed_out"`
+	Truncated bool   `json:"truncated"`
+	Output    string `json:"output"`
+	Stdout    string `json:"stdout"` // same as Output, for compatibility
+	Stderr    string `json:"stderr"`
+}
+
+// newResult returns the outcome of rn, with stdout as the output captured so
+// far, and truncated whether it was truncated. The exit code is -1 if rn is
+// still running.
+func newResult(rn *run, stdout string, truncated bool) result {
+	res := result{
+		Status:    "started",
+		Pid:       rn.cmd.Process.Pid,
+		Started:   rn.start.Format(time.RFC3339),
+		Duration:  time.Since(rn.start).String(),
+		ExitCode:  -1,
+		Truncated: truncated,
+		Output:    stdout,
+		Stdout:    stdout,
+		Stderr:    rn.stderr.String(),
+	}
+	if rn.done() {
+		res.Status = "exited"
+		res.Duration = rn.end.Sub(rn.start).String()
+		res.ExitCode = exitCode(rn.err)
+		res.TimedOut = rn.timedOut()
+	}
+	return res
+}
+
+// sendResult replies with the outcome of rn as JSON, with stdout as the
+// output captured so far, and truncated whether it was truncated.
+func sendResult(w http.ResponseWriter, r *http.Request, rn *run, stdout *bytes.Buffer, truncated bool) {
+	res := newResult(rn, stdout.String(), truncated)
+	if err := json.NewEncoder(throttle(r.Context(), w)).Encode(res); err != nil {
+		logf(r.Context(), "error sending result: %v", err)
+	}
+	w.Header().Set("X-Exit-Code", fmt.Sprintf("%d", res.ExitCode))
+	if res.TimedOut {
+		w.Header().Set("X-Timed-Out", "true")
+	}
+	if res.Truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+}
+
+// setContentHeaders sets the headers describing the output of the command,
+// which is an attachment if the download parameter is set, and not text if
+// binary.
+func setContentHeaders(w http.ResponseWriter, r *http.Request, binary bool) {
+	name := r.FormValue("download")
+	if name == "" {
+		if binary {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+}
+
+// streamOutput copies the output of a command to w, flushing as soon as some
+// output is available, until the command has exited. It returns early, with
+// the context's error, if ctx is done.
+func streamOutput(ctx context.Context, w io.Writer, flusher http.Flusher, lw *limitWriter, exited <-chan struct{}) error {
+	flusher.Flush()
+	for {
+		n, err := io.Copy(w, lw)
+		if err != nil {
+			logf(ctx, "output copy error: %v", err)
+			return nil
+		}
+		if n > 0 {
+			flusher.Flush()
+			continue
+		}
+		select {
+		case <-exited:
+			// The output was all written by the time the command exited.
+			if _, err := io.Copy(w, lw); err != nil {
+				logf(ctx, "output copy error: %v", err)
+			}
+			flusher.Flush()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// exitCode returns the exit status corresponding to err, as returned by
+// exec.Cmd.Wait, or -1 if it can't be determined.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// shutdown kills all the children, and then gracefully stops srv.
+func shutdown(srv *http.Server) {
+	stopSupervising()
+	close(sweepStop)
+	drained, killed := drainChildren(*flagDrainTimeout)
+	log.Printf("%d children drained, %d killed", drained, killed)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("could not gracefully shut down: %v", err)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == rlimitExecArg {
+		rlimitExec(os.Args[2:])
+	}
 	flag.Usage = usage
 	flag.Parse()
 	if *flagHelp {
@@ -283,22 +1480,156 @@ func main() {
 	if nargs > 0 {
 		usage()
 	}
-	if *flagCommand == "" {
+	if len(flagCommand) == 0 && *flagConfig == "" && *flagCommandFile == "" {
 		fmt.Printf("No command to run")
 		usage()
 	}
+	if err := checkLogFormat(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagLogFile != "" {
+		if err := openLogFile(); err != nil {
+			log.Fatalf("could not open -log-file: %v", err)
+		}
+		go reopenLogFileOnHUP()
+	}
+	if *flagArgAllow != "" {
+		re, err := regexp.Compile("^(?:" + *flagArgAllow + ")$")
+		if err != nil {
+			log.Fatalf("invalid -arg-allow: %v", err)
+		}
+		argAllow = re
+	}
+	if *flagIdleKill < 0 {
+		log.Fatalf("invalid -idle-kill %v, must not be negative", *flagIdleKill)
+	}
+	if *flagRunAsUser != "" {
+		if err := setRunAsUser(*flagRunAsUser); err != nil {
+			log.Fatalf("invalid -run-as-user: %v", err)
+		}
+	}
+	if err := checkRlimits(); err != nil {
+		log.Fatal(err)
+	}
+	if *flagAbuseHook != "" {
+		words, err := splitWords(*flagAbuseHook)
+		if err != nil || len(words) == 0 {
+			log.Fatalf("invalid -abuse-hook %q: %v", *flagAbuseHook, err)
+		}
+		abuseHook = words
+	}
+	if *flagWorkdir != "" {
+		if fi, err := os.Stat(*flagWorkdir); err != nil || !fi.IsDir() {
+			log.Fatalf("-workdir %v is not a directory", *flagWorkdir)
+		}
+		rootdir = *flagWorkdir
+	}
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnHUP()
 
 	initUserPass()
-	children = make(map[time.Time]*os.Process)
+	if err := checkCORSOrigin(); err != nil {
+		log.Fatal(err)
+	}
+	initAllowedNets()
+	children = make(map[int]*child)
+	lastRun = make(map[runKey]time.Time)
+	if *flagQueue > 0 {
+		queue = make(chan struct{}, *flagQueue)
+	}
+	go cleanLastRun()
+	go sweepChildren()
 
-	listener, err := simpletls.Listen(*flagHost)
+	listeners, err := listen()
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", *flagHost, err)
+		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	http.Handle("/run", makeHandler(handleCommand))
-	http.Handle("/kill", makeHandler(handleKillAll))
-	http.Handle("/die", makeHandler(handleDie))
+	if *flagSupervise {
+		args, ok := cfg.commandArgs[""]
+		if !ok {
+			log.Fatal("-supervise requires a default command")
+		}
+		noParam := func(string) (string, bool) { return "", false }
+		if _, err := expandArgs(args, noParam); err != nil {
+			log.Fatalf("-supervise does not allow placeholders in the command: %v", err)
+		}
+		go supervise(args)
+	} else {
+		http.Handle("/run", makeHandler(postOnly(handleCommand)))
+		http.Handle("/run/", makeHandler(postOnly(handleNamedCommand)))
+		if !*flagDisableRestart {
+			http.Handle("/restart", makeHandler(postOnly(handleRestart)))
+		}
+	}
+	if !*flagDisableKill {
+		http.Handle("/kill", makeHandler(postOnly(confirmed(handleKillAll))))
+		if !*flagSupervise {
+			http.Handle("/cancel", makeHandler(postOnly(confirmed(handleCancel))))
+		}
+	}
+	if !*flagDisableDie {
+		http.Handle("/die", makeHandler(postOnly(confirmed(handleDie))))
+	}
 	http.Handle("/ls", makeHandler(handleList))
-	log.Fatal(http.Serve(listener, nil))
+	http.Handle("/tail", makeHandler(handleTail))
+	http.Handle("/last", makeHandler(handleLast))
+	http.Handle("/stats", makeHandler(handleStats))
+	http.Handle("/config", makeHandler(handleConfig))
+	http.Handle("/status", makeHandler(handleStatus))
+	http.Handle("/ui", makeHandler(handleUI))
+	if *flagHealthNoAuth {
+		http.Handle("/health", makePublicHandler(handleHealth))
+	} else {
+		http.Handle("/health", makeHandler(handleHealth))
+	}
+	if *flagReadyNoAuth {
+		http.Handle("/ready", makePublicHandler(handleReady))
+	} else {
+		http.Handle("/ready", makeHandler(handleReady))
+	}
+	if *flagVersionNoAuth {
+		http.Handle("/version", makePublicHandler(handleVersion))
+	} else {
+		http.Handle("/version", makeHandler(handleVersion))
+	}
+	if *flagMetrics {
+		http.Handle("/metrics", makeHandler(promhttp.Handler().ServeHTTP))
+	}
+
+	srv := &http.Server{}
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		var expired <-chan time.Time
+		if *flagMaxUptime > 0 {
+			log.Printf("will shut down at %v", serverStart.Add(*flagMaxUptime).Format(time.RFC3339))
+			expired = time.After(time.Until(serverStart.Add(*flagMaxUptime)))
+		}
+		select {
+		case s := <-sig:
+			log.Printf("received %v, shutting down", s)
+		case <-expired:
+			log.Printf("up for more than %v, shutting down", *flagMaxUptime)
+		}
+		shutdown(srv)
+		close(stopped)
+	}()
+	ready.Store(true)
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- srv.Serve(l)
+		}(l)
+	}
+	for range listeners {
+		if err := <-errc; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-stopped
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	children = make(map[int]*child)
+	lastRun = make(map[runKey]time.Time)
+	os.Exit(m.Run())
+}
+
+// writeConcurrently writes n times p to lw, from as many goroutines.
+func writeConcurrently(lw *limitWriter, p []byte, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lw.Write(p); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLimitWriterHead(t *testing.T) {
+	lw := &limitWriter{limit: 1000, buf: new(bytes.Buffer)}
+	writeConcurrently(lw, bytes.Repeat([]byte("a"), 30), 100)
+	out, err := io.ReadAll(lw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1000 {
+		t.Errorf("got %d bytes, want 1000", len(out))
+	}
+	if !lw.truncated() {
+		t.Error("not truncated")
+	}
+}
+
+func TestLimitWriterUnderLimit(t *testing.T) {
+	lw := &limitWriter{limit: 1000, buf: new(bytes.Buffer)}
+	writeConcurrently(lw, []byte("abc"), 10)
+	out, err := io.ReadAll(lw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 30 {
+		t.Errorf("got %d bytes, want 30", len(out))
+	}
+	if lw.truncated() {
+		t.Error("truncated")
+	}
+}
+
+func TestLimitWriterTail(t *testing.T) {
+	lw := &limitWriter{limit: 10, keepTail: true, buf: new(bytes.Buffer)}
+	for _, s := range []string{"0123456789", "abcdef", "ghijklmnopqrstuvwxyz", "ABC"} {
+		if _, err := lw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := io.ReadAll(lw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "tuvwxyzABC"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if !lw.truncated() {
+		t.Error("not truncated")
+	}
+}
+
+func TestLimitWriterTailConcurrent(t *testing.T) {
+	lw := &limitWriter{limit: 1000, keepTail: true, buf: new(bytes.Buffer)}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// Reading, as the handlers do, only frees room for more.
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			io.Copy(io.Discard, lw)
+		}
+	}()
+	writeConcurrently(lw, bytes.Repeat([]byte("a"), 30), 100)
+	wg.Wait()
+	lw.bufMu.Lock()
+	n := lw.buf.Len()
+	lw.bufMu.Unlock()
+	if n > 1000 {
+		t.Errorf("%d unread bytes kept, want at most 1000", n)
+	}
+}
+
+func TestLimitWriterTails(t *testing.T) {
+	lw := &limitWriter{limit: 100, buf: new(bytes.Buffer)}
+	lw.Write([]byte("before "))
+	tl := lw.tail()
+	lw.Write([]byte("after"))
+	lw.untail(tl)
+	lw.Write([]byte(" untailed"))
+	out, err := io.ReadAll(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "before after"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestRecoverString(t *testing.T) {
+	h := makeHandler(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/ls", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", rec.Code)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "boom") {
+		t.Errorf("body %q reveals the panic value", body)
+	}
+	if id := rec.Header().Get("X-Request-ID"); id == "" || !strings.Contains(body, id) {
+		t.Errorf("body %q does not have the request ID %q", body, id)
+	}
+}
+
+func TestRecoverAfterHeader(t *testing.T) {
+	h := makeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		panic("boom")
+	})
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/ls", nil))
+	t.Error("no panic")
+}
+
+func TestRecoverOverHTTP(t *testing.T) {
+	srv := httptest.NewServer(makeHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic("boom")
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The connection is closed instead of ending the response normally.
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("aborted response read without error")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	defer func(origin, token string) {
+		*flagCORSOrigin, *flagToken = origin, token
+	}(*flagCORSOrigin, *flagToken)
+	tests := []struct {
+		allowed     string
+		token       string
+		origin      string
+		want        string
+		credentials bool
+	}{
+		{allowed: "*", origin: "https://evil.example", want: "*"},
+		{allowed: "*", origin: "null"},
+		{allowed: "https://a.example", token: "secret", origin: "https://a.example", want: "https://a.example", credentials: true},
+		{allowed: "https://a.example, https://b.example", token: "secret", origin: "https://b.example", want: "https://b.example", credentials: true},
+		{allowed: "https://a.example", token: "secret", origin: "https://evil.example"},
+		{allowed: "https://a.example", token: "secret", origin: "https://a.example.evil.example"},
+		{allowed: "https://a.example", token: "secret", origin: "null"},
+		{allowed: "https://a.example", token: "secret"},
+	}
+	for _, tt := range tests {
+		*flagCORSOrigin, *flagToken = tt.allowed, tt.token
+		r := httptest.NewRequest("GET", "/ls", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		setCORSHeaders(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("%q allowed, origin %q: got Access-Control-Allow-Origin %q, want %q", tt.allowed, tt.origin, got, tt.want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.credentials {
+			t.Errorf("%q allowed, origin %q: got credentials %v, want %v", tt.allowed, tt.origin, got, tt.credentials)
+		}
+	}
+}
+
+func TestCORSWildcardWithAuth(t *testing.T) {
+	defer func(origin, token string) {
+		*flagCORSOrigin, *flagToken = origin, token
+	}(*flagCORSOrigin, *flagToken)
+	*flagToken = "secret"
+	for _, allowed := range []string{"*", "https://a.example, *"} {
+		*flagCORSOrigin = allowed
+		if err := checkCORSOrigin(); err == nil {
+			t.Errorf("%q allowed with authentication: no error", allowed)
+		}
+	}
+	*flagCORSOrigin = "https://a.example"
+	if err := checkCORSOrigin(); err != nil {
+		t.Errorf("listed origin with authentication: %v", err)
+	}
+	*flagToken = ""
+	*flagCORSOrigin = "*"
+	if err := checkCORSOrigin(); err != nil {
+		t.Errorf("* without authentication: %v", err)
+	}
+}
+
+func TestCheckCommandFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are only checked on Unix")
+	}
+	dir := t.TempDir()
+	mkdir := func(name string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.Mkdir(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		// Not to depend on the umask.
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	program := func(dir, name string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"), perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	safe, unsafe := mkdir("safe", 0o755), mkdir("unsafe", 0o777)
+	link := filepath.Join(safe, "link")
+	if err := os.Symlink(program(unsafe, "target", 0o755), link); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{program(safe, "ok", 0o755), true},
+		{program(safe, "writable", 0o757), false},
+		{program(unsafe, "indir", 0o755), false},
+		{link, false},
+		{filepath.Join(safe, "missing"), false},
+	}
+	for _, tt := range tests {
+		err := checkCommandFile(tt.path)
+		if tt.ok && err != nil {
+			t.Errorf("%v: %v", tt.path, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%v: no error", tt.path)
+		}
+	}
+}
+
+func TestArgAllow(t *testing.T) {
+	defer func(placeholders string, allowArgs bool, re *regexp.Regexp) {
+		*flagPlaceholders, *flagAllowArgs, argAllow = placeholders, allowArgs, re
+	}(*flagPlaceholders, *flagAllowArgs, argAllow)
+	*flagPlaceholders, *flagAllowArgs = "Name", true
+	argAllow = regexp.MustCompile("^(?:[a-z]+)$")
+	args := []string{"echo", "hello-{{.Name}}"}
+	tests := []struct {
+		query string
+		json  string
+		want  []string // nil if rejected
+	}{
+		{query: "Name=world", want: []string{"echo", "hello-world"}},
+		{query: "Name=world&args=foo+bar", want: []string{"echo", "hello-world", "foo", "bar"}},
+		{query: "Name=World"},
+		{query: "Name=-rf"},
+		{query: "Name=a+b"},
+		{query: "Name=world&args=--evil"},
+		{query: "Name=world&args=foo+Bar"},
+		{json: `{"params": {"Name": "world"}}`, want: []string{"echo", "hello-world"}},
+		{json: `{"params": {"Name": "../etc"}}`},
+		{json: `{"params": {"Name": "world"}, "args": ["-x"]}`},
+	}
+	for _, tt := range tests {
+		name, r := tt.query, httptest.NewRequest("POST", "/run?"+tt.query, nil)
+		if tt.json != "" {
+			name, r = tt.json, httptest.NewRequest("POST", "/run", strings.NewReader(tt.json))
+			r.Header.Set("Content-Type", "application/json")
+		}
+		opts, err := parseRun(r, args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: not rejected, got %q", name, opts.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if strings.Join(opts.args, "\x00") != strings.Join(tt.want, "\x00") {
+			t.Errorf("%s: got %q, want %q", name, opts.args, tt.want)
+		}
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	defer func(hosts string) { *flagCallbackHosts = hosts }(*flagCallbackHosts)
+	*flagCallbackHosts = "hooks.example, 10.0.0.1:8080, [::1]"
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://hooks.example/done", true},
+		{"http://HOOKS.example:9000/done", true},
+		{"http://10.0.0.1:8080/", true},
+		{"http://[::1]:8080/", true},
+		{"http://10.0.0.1/", false},
+		{"http://10.0.0.1:8081/", false},
+		{"http://evil.example/", false},
+		{"http://hooks.example.evil.example/", false},
+		{"http://evil.example/?hooks.example", false},
+		{"http://hooks.example@evil.example/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"file:///etc/passwd", false},
+		{"gopher://hooks.example/", false},
+		{"::", false},
+	}
+	for _, tt := range tests {
+		err := checkCallback(tt.url)
+		if tt.ok && err != nil {
+			t.Errorf("%v: %v", tt.url, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%v: not rejected", tt.url)
+		}
+	}
+	*flagCallbackHosts = ""
+	if err := checkCallback("https://hooks.example/done"); err == nil {
+		t.Error("callback allowed without -callback-hosts")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool) { *flagTrustForwarded = trust }(*flagTrustForwarded)
+	tests := []struct {
+		trust     bool
+		forwarded []string
+		want      string
+	}{
+		{false, nil, "192.0.2.1"},
+		{false, []string{"198.51.100.7"}, "192.0.2.1"},
+		{true, nil, "192.0.2.1"},
+		{true, []string{"198.51.100.7"}, "198.51.100.7"},
+		// The first entries are whatever the client sent.
+		{true, []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{true, []string{"203.0.113.9,198.51.100.7"}, "198.51.100.7"},
+		{true, []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{true, []string{"203.0.113.9", "10.0.0.1, 198.51.100.7"}, "198.51.100.7"},
+		{true, []string{""}, "192.0.2.1"},
+		{true, []string{"203.0.113.9, "}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		*flagTrustForwarded = tt.trust
+		r := httptest.NewRequest("POST", "/run", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: got %v, want %v", tt.trust, tt.forwarded, got, tt.want)
+		}
+	}
+}
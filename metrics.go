@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httprunner",
+		Name:      "runs_total",
+		Help:      "Number of commands started.",
+	})
+	metricFailedRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httprunner",
+		Name:      "failed_runs_total",
+		Help:      "Number of commands that failed to start, or that exited with an error.",
+	})
+	metricKilled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httprunner",
+		Name:      "killed_total",
+		Help:      "Number of children killed through /kill or /die.",
+	})
+	metricRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "httprunner",
+		Name:      "rate_limited_total",
+		Help:      "Number of runs rejected because of rate limiting.",
+	})
+	metricChildren = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "httprunner",
+		Name:      "children",
+		Help:      "Number of currently running children.",
+	}, func() float64 {
+		childrenMu.RLock()
+		defer childrenMu.RUnlock()
+		return float64(len(children))
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricRuns, metricFailedRuns, metricKilled, metricRateLimited, metricChildren)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runOptions are what a request to /run asks for.
+type runOptions struct {
+	name    string // of the command, empty for the default one
+	args    []string
+	env     []string  // added to the environment of httprunner
+	stdin   io.Reader // nil if none
+	timeout time.Duration
+	// callback is the URL notified once the command has exited, if any.
+	callback string
+	// requestID is the ID of the request that started the command, if any.
+	requestID string
+	// grep, if not nil, selects the lines of output sent in the response.
+	grep *regexp.Regexp
+	// jsonl is whether the response has both stdout and stderr, streamed as
+	// JSON lines.
+	jsonl bool
+	// binary is whether the response has only the output of the command,
+	// which is not text.
+	binary bool
+	// framed is whether the response has both stdout and stderr, with each
+	// line prefixed with the name of its stream.
+	framed bool
+	// logName is the name of the file, in -log-dir, where the output is
+	// written, before the start time is appended.
+	logName string
+}
+
+// jsonParams is the format of the JSON request bodies accepted by /run, as an
+// alternative to the query parameters.
+type jsonParams struct {
+	Args     []string          `json:"args"`
+	Env      map[string]string `json:"env"`
+	Timeout  string            `json:"timeout"`
+	Stdin    *string           `json:"stdin"`
+	Callback string            `json:"callback"`
+	// Params are the values of the placeholders of the command.
+	Params map[string]string `json:"params"`
+}
+
+// argAllow, if not nil, is what each of the arguments of a request must match,
+// from -arg-allow.
+var argAllow *regexp.Regexp
+
+// isJSON reports whether the body of r is JSON.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// hasStdinBody reports whether the body of r, which is not JSON, is to be sent
+// to the command's stdin.
+func hasStdinBody(r *http.Request) bool {
+	return *flagAllowStdin && !isJSON(r) && r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// formParam returns a function that returns the value of the form parameter of
+// r with the given name, and whether it is set. r.Form must already be parsed.
+func formParam(r *http.Request) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		vs, ok := r.Form[name]
+		if !ok || len(vs) == 0 {
+			return "", false
+		}
+		return vs[0], true
+	}
+}
+
+// parseRun returns the options of a run of the command with the args words,
+// with the parameters of r, either from a JSON body or from the query.
+func parseRun(r *http.Request, args []string) (*runOptions, error) {
+	var p jsonParams
+	if isJSON(r) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, int64(*flagStdinLimit)+1<<10)).Decode(&p); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+	} else {
+		if hasStdinBody(r) {
+			// The body is for the command's stdin, and must not be consumed
+			// as form values, nor taken as parameters.
+			r.Form = r.URL.Query()
+			r.PostForm = url.Values{}
+		} else {
+			var tooLarge *http.MaxBytesError
+			if err := r.ParseForm(); errors.As(err, &tooLarge) {
+				return nil, err
+			}
+		}
+		if *flagAllowArgs {
+			var err error
+			if p.Args, err = splitWords(r.FormValue("args")); err != nil {
+				return nil, fmt.Errorf("invalid args: %v", err)
+			}
+		}
+		p.Env = make(map[string]string)
+		for _, kv := range r.Form["env"] {
+			if i := strings.Index(kv, "="); i > 0 {
+				p.Env[kv[:i]] = kv[i+1:]
+			}
+		}
+		p.Timeout = r.FormValue("timeout")
+		p.Callback = r.FormValue("callback")
+	}
+	param := formParam(r)
+	if isJSON(r) {
+		param = func(name string) (string, bool) {
+			v, ok := p.Params[name]
+			return v, ok
+		}
+	}
+	if err := checkPlaceholderValues(args, param); err != nil {
+		return nil, err
+	}
+	args, err := expandArgs(args, param)
+	if err != nil {
+		return nil, err
+	}
+	opts := &runOptions{
+		requestID: requestID(r.Context()),
+		args:      args,
+		env:       append((*flagEnv)[:len(*flagEnv):len(*flagEnv)], allowedEnv(p.Env)...),
+	}
+	if *flagAllowArgs {
+		if argAllow != nil {
+			for _, arg := range p.Args {
+				if !argAllow.MatchString(arg) {
+					return nil, fmt.Errorf("argument %q not allowed", arg)
+				}
+			}
+		}
+		opts.args = append(args[:len(args):len(args)], p.Args...)
+	}
+	if opts.timeout, err = parseTimeout(p.Timeout); err != nil {
+		return nil, err
+	}
+	if pattern := r.FormValue("grep"); pattern != "" {
+		if opts.grep, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid grep: %v", err)
+		}
+	}
+	opts.framed = r.FormValue("framed") != ""
+	opts.binary = r.FormValue("binary") != ""
+	if opts.binary && (opts.grep != nil || opts.framed) {
+		return nil, errors.New("binary can't be used with grep or framed")
+	}
+	opts.jsonl = r.FormValue("format") == "jsonl"
+	if opts.jsonl && (opts.grep != nil || opts.framed || opts.binary) {
+		return nil, errors.New("format=jsonl can't be used with grep, framed, or binary")
+	}
+	if name := r.FormValue("logfile"); name != "" {
+		if *flagLogDir == "" {
+			return nil, errors.New("logfile requires -log-dir")
+		}
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid logfile %q", name)
+		}
+		opts.logName = name
+	}
+	if p.Callback != "" {
+		if err := checkCallback(p.Callback); err != nil {
+			return nil, err
+		}
+		opts.callback = p.Callback
+	}
+	if *flagAllowStdin {
+		if p.Stdin != nil {
+			opts.stdin = io.LimitReader(strings.NewReader(*p.Stdin), int64(*flagStdinLimit))
+		} else if hasStdinBody(r) {
+			opts.stdin = io.LimitReader(r.Body, int64(*flagStdinLimit))
+		}
+	}
+	return opts, nil
+}
+
+// allowedEnv returns, as KEY=VALUE, the variables of env that are allowed with
+// -allow-env.
+func allowedEnv(env map[string]string) []string {
+	if *flagAllowEnv == "" {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(*flagAllowEnv, ",") {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	var kvs []string
+	for k, v := range env {
+		if allowed[k] {
+			kvs = append(kvs, k+"="+v)
+		}
+	}
+	sort.Strings(kvs)
+	return kvs
+}
+
+// parseTimeout parses the timeout parameter of a run, which can't be longer
+// than -timeout. It returns -timeout if param is empty.
+func parseTimeout(param string) (time.Duration, error) {
+	if param == "" {
+		return *flagTimeout, nil
+	}
+	timeout, err := time.ParseDuration(param)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", param)
+	}
+	if *flagTimeout != 0 && timeout > *flagTimeout {
+		return 0, fmt.Errorf("timeout %v is longer than the maximum of %v", timeout, *flagTimeout)
+	}
+	return timeout, nil
+}
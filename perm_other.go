@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// checkCommandFile does nothing, the permissions of files are only checked on
+// Unix.
+func checkCommandFile(path string) error {
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// checkCommandFile returns an error if the program at path, or the directory
+// it is in, could be modified by another user than root or the one running
+// the server.
+func checkCommandFile(path string) error {
+	if err := checkOwner(path); err != nil {
+		return err
+	}
+	// Whoever can write to the directory can replace the program, so the
+	// directory of its link, if any, and the one of its target are checked.
+	dirs := []string{filepath.Dir(path)}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && filepath.Dir(resolved) != dirs[0] {
+		dirs = append(dirs, filepath.Dir(resolved))
+	}
+	for _, dir := range dirs {
+		if err := checkOwner(dir); err != nil {
+			return fmt.Errorf("its directory %v: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// checkOwner returns an error if the file at path is world-writable, or owned
+// by another user than root or the one running the server.
+func checkOwner(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0o002 != 0 {
+		return errors.New("it is world-writable")
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if st.Uid != 0 && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("it is owned by uid %d, neither root nor the user of the server", st.Uid)
+	}
+	return nil
+}
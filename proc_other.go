@@ -0,0 +1,37 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// setNice is not supported on this platform.
+func setNice(pid, nice int) error {
+	return errors.New("-nice is only supported on Unix")
+}
+
+// setRunAsUser is not supported on this platform.
+func setRunAsUser(name string) error {
+	return errors.New("-run-as-user is only supported on Unix")
+}
+
+// setProcAttr does nothing, process groups and -run-as-user are only
+// supported on Unix.
+func setProcAttr(cmd *exec.Cmd) {}
+
+// signalGroup sends sig to p only.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	if sig == os.Kill {
+		return p.Kill()
+	}
+	return p.Signal(sig)
+}
+
+// processExists always reports true, as there is no way to check for the
+// process without signaling it on this platform.
+func processExists(p *os.Process) bool {
+	return true
+}
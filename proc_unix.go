@@ -0,0 +1,75 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// runAs is the user the children run as, with -run-as-user.
+var runAs *syscall.Credential
+
+// setNice sets the niceness of the process with the given pid.
+func setNice(pid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice)
+}
+
+// setRunAsUser looks up the user with the given name or uid, for the children
+// to run as.
+func setRunAsUser(name string) error {
+	lookup := user.Lookup
+	if _, err := strconv.Atoi(name); err == nil {
+		lookup = user.LookupId
+	}
+	u, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of %v: %v", u.Uid, name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of %v: %v", u.Gid, name, err)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("could not get the groups of %v: %v", name, err)
+	}
+	for _, g := range gids {
+		if gid, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(gid))
+		}
+	}
+	runAs = cred
+	return nil
+}
+
+// setProcAttr makes cmd run in its own process group, so that it can be
+// signaled along with its own children, and, with -run-as-user, as that user.
+func setProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: runAs}
+}
+
+// signalGroup sends sig to the process group of p, which was started with
+// setProcAttr.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return p.Signal(sig)
+	}
+	return syscall.Kill(-p.Pid, s)
+}
+
+// processExists reports whether p is still running, or at least not reaped
+// yet.
+func processExists(p *os.Process) bool {
+	return p.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// queue holds a token for each request waiting for its turn with -queue.
+var queue chan struct{}
+
+// waitTurn waits until the client that sent r is allowed to run the named
+// command, and reports whether it is. Otherwise, because the queue is full,
+// because the wait would be longer than -queue-wait, or because the client
+// went away, it has already replied with a 503.
+func waitTurn(w http.ResponseWriter, r *http.Request, name string) bool {
+	select {
+	case queue <- struct{}{}:
+	default:
+		http.Error(w, "Too many requests waiting for their turn", http.StatusServiceUnavailable)
+		return false
+	}
+	defer func() { <-queue }()
+	key := runKey{name, clientIP(r)}
+	deadline := time.Now().Add(*flagQueueWait)
+	for {
+		rate := currentConfig().rate
+		lastRunMu.Lock()
+		next := lastRun[key].Add(rate)
+		if !time.Now().Before(next) {
+			// Taking the turn right away, so that no other waiting
+			// request takes it too.
+			lastRun[key] = time.Now()
+			lastRunMu.Unlock()
+			return true
+		}
+		lastRunMu.Unlock()
+		if next.After(deadline) {
+			setRetryAfter(w, time.Until(next))
+			noteRateLimited(r, name)
+			http.Error(w, "Command process creation is rate limited", http.StatusServiceUnavailable)
+			return false
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-r.Context().Done():
+			http.Error(w, "Gave up waiting", http.StatusServiceUnavailable)
+			return false
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateWriter is a token bucket that limits the writes to w to rate bytes per
+// second, with bursts of up to a second's worth.
+type rateWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// throttle returns w, with its writes limited to -output-rate, if set, until
+// ctx is done.
+func throttle(ctx context.Context, w io.Writer) io.Writer {
+	if *flagOutputRate <= 0 {
+		return w
+	}
+	rate := float64(*flagOutputRate)
+	return &rateWriter{ctx: ctx, w: w, rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (rw *rateWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		now := time.Now()
+		rw.tokens += now.Sub(rw.last).Seconds() * rw.rate
+		if rw.tokens > rw.rate {
+			rw.tokens = rw.rate
+		}
+		rw.last = now
+		if rw.tokens < 1 {
+			wait := time.Duration((1 - rw.tokens) / rw.rate * float64(time.Second))
+			select {
+			case <-time.After(wait):
+			case <-rw.ctx.Done():
+				return written, rw.ctx.Err()
+			}
+			continue
+		}
+		chunk := p
+		if n := int(rw.tokens); len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		n, err := rw.w.Write(chunk)
+		written += n
+		rw.tokens -= float64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
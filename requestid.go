@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLen is the longest X-Request-ID accepted from a client.
+const maxRequestIDLen = 128
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("could not generate request ID: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns r with a request ID in its context: the one from its
+// X-Request-ID header if valid, or a new one.
+func withRequestID(r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return r.WithContext(contextWithRequestID(r.Context(), id))
+}
+
+// validRequestID reports whether id is short, and only made of printable
+// ASCII characters without spaces, so that it can safely appear in the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID in ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf is like log.Printf, with the request ID in ctx, if any, as a prefix.
+func logf(ctx context.Context, format string, v ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// rlimitExecArg, as the first argument of httprunner, makes it set the
+// resource limits given as the next arguments, up to "--", and then execute
+// the command made of the arguments after "--". That is how the limits are
+// applied to the children only.
+const rlimitExecArg = "-internal-rlimit-exec"
+
+// rlimitArgs returns the arguments for rlimitExec that apply -limit-cpu,
+// -limit-memory, and -limit-files, or nil if none of them is set.
+func rlimitArgs() []string {
+	var limits []string
+	if *flagLimitCPU > 0 {
+		// Rounded up, as the limit is in seconds.
+		limits = append(limits, fmt.Sprintf("cpu=%d", (*flagLimitCPU+time.Second-1)/time.Second))
+	}
+	if *flagLimitMemory > 0 {
+		limits = append(limits, fmt.Sprintf("as=%d", int64(*flagLimitMemory)))
+	}
+	if *flagLimitFiles > 0 {
+		limits = append(limits, fmt.Sprintf("nofile=%d", *flagLimitFiles))
+	}
+	return limits
+}
+
+// withRlimits returns args, wrapped to be run with the resource limits, if
+// any.
+func withRlimits(args []string) ([]string, error) {
+	limits := rlimitArgs()
+	if limits == nil {
+		return args, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find httprunner's executable to apply the resource limits: %v", err)
+	}
+	wrapped := append([]string{self, rlimitExecArg}, limits...)
+	wrapped = append(wrapped, "--")
+	return append(wrapped, args...), nil
+}
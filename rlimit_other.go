@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// checkRlimits returns an error if the resource limits can't be applied.
+func checkRlimits() error {
+	if rlimitArgs() != nil {
+		return errors.New("-limit-cpu, -limit-memory, and -limit-files are only supported on Linux and macOS")
+	}
+	return nil
+}
+
+// rlimitExec is never used on this platform.
+func rlimitExec(args []string) {
+	os.Exit(127)
+}
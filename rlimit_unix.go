@@ -0,0 +1,76 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var rlimitResources = map[string]int{
+	"cpu":    syscall.RLIMIT_CPU,
+	"as":     syscall.RLIMIT_AS,
+	"nofile": syscall.RLIMIT_NOFILE,
+}
+
+// checkRlimits returns an error if the resource limits can't be applied.
+// With -run-as-user, they are applied by httprunner's executable running as
+// that user, so it is checked that the user can run it.
+func checkRlimits() error {
+	if rlimitArgs() == nil || runAs == nil {
+		return nil
+	}
+	args, err := withRlimits(nil)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	setProcAttr(cmd)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("could not apply the resource limits as -run-as-user %v, who must be able to run %v: %v %s", *flagRunAsUser, args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// rlimitExec sets the limits in args, up to "--", and executes the command
+// after it. It only returns on failure, by exiting.
+func rlimitExec(args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "httprunner: %v\n", err)
+		os.Exit(127)
+	}
+	for len(args) > 0 && args[0] != "--" {
+		kv := strings.SplitN(args[0], "=", 2)
+		resource, ok := rlimitResources[kv[0]]
+		if !ok || len(kv) != 2 {
+			fail(fmt.Errorf("invalid resource limit %q", args[0]))
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			fail(fmt.Errorf("invalid resource limit %q", args[0]))
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: n, Max: n}); err != nil {
+			fail(fmt.Errorf("could not set %v limit: %v", kv[0], err))
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fail(fmt.Errorf("no command to run"))
+	}
+	if len(args) == 1 {
+		// Nothing after "--", as when checkRlimits checks that the limits
+		// can be applied.
+		os.Exit(0)
+	}
+	args = args[1:]
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(path, args, os.Environ()))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitWords splits s into words, the way a POSIX shell would, without any
+// expansion. Words are separated by unquoted whitespace. Within single quotes,
+// all characters are literal. Within double quotes, a backslash only escapes
+// '"', '\', '$', and '`'. Elsewhere, a backslash escapes the next character.
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		escaped bool
+		quote   rune // the current quote character, or 0
+	)
+	for _, c := range s {
+		if escaped {
+			if quote == '"' && !strings.ContainsRune("\"\\$`", c) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+			continue
+		}
+		switch {
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
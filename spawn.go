@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errTooManyChildren is returned by spawn when -max-concurrent children are
+// already running.
+var errTooManyChildren = errors.New("too many commands already running")
+
+// errDraining is returned by spawn when the server is shutting down.
+var errDraining = errors.New("shutting down")
+
+// run is a command started by spawn.
+type run struct {
+	cmd    *exec.Cmd
+	start  time.Time
+	stdout *limitWriter
+	stderr *syncBuffer
+	// timeout is how long the command is allowed to run, 0 for no limit.
+	timeout time.Duration
+	// output keeps the output for the history, if enabled, or for the
+	// callback.
+	output *limitWriter
+	// callback is the URL notified once the command has exited, if any.
+	callback string
+	// events, if not nil, gets both stdout and stderr, as JSON lines.
+	events *events
+	// framed, if not nil, gets both stdout and stderr, with each line
+	// prefixed with the name of its stream.
+	framed *limitWriter
+	// ctx is done when the command has timed out, or once it has exited.
+	ctx context.Context
+
+	exited chan struct{} // closed once the command has exited
+	err    error         // returned by Wait. Only valid once exited is closed.
+	end    time.Time     // when the command exited. Only valid once exited is closed.
+}
+
+// done reports whether the command has exited.
+func (rn *run) done() bool {
+	select {
+	case <-rn.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// timedOut reports whether the command was killed because of -timeout.
+func (rn *run) timedOut() bool {
+	return rn.ctx.Err() == context.DeadlineExceeded
+}
+
+// spawn starts the command described by opts, and records it in children
+// until it exits. If opts.stdin is not nil, it is copied to the command's
+// stdin before spawn returns. If opts.timeout is not 0, the command is killed
+// once it has run for that long.
+func spawn(opts *runOptions) (*run, error) {
+	args, env, stdin, timeout := opts.args, opts.env, opts.stdin, opts.timeout
+	if *flagNoPrecheck && !*flagInsecureCommand {
+		// The program was not checked at startup, so it is now.
+		if err := checkCommand(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	cmdArgs, err := withRlimits(args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := contextWithRequestID(context.Background(), opts.requestID), func() {}
+	if timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Dir = rootdir
+	// The command's own children are killed along with it.
+	setProcAttr(cmd)
+	cmd.Cancel = func() error {
+		return signalGroup(cmd.Process, os.Kill)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	rn := &run{
+		cmd: cmd,
+		stdout: &limitWriter{
+			limit:    int(*flagOutputLimit),
+			keepTail: *flagTruncateTail,
+			buf:      new(bytes.Buffer),
+		},
+		stderr:   new(syncBuffer),
+		timeout:  timeout,
+		callback: opts.callback,
+		ctx:      ctx,
+		exited:   make(chan struct{}),
+	}
+	stdout := []io.Writer{os.Stdout, rn.stdout}
+	if *flagHistory > 0 || rn.callback != "" {
+		rn.output = &limitWriter{
+			limit:    int(*flagOutputLimit),
+			keepTail: *flagTruncateTail,
+			buf:      new(bytes.Buffer),
+		}
+		stdout = append(stdout, rn.output)
+	}
+	var logFile *os.File
+	if *flagLogDir != "" {
+		var err error
+		if logFile, err = createLogFile(opts); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	stderr := []io.Writer{rn.stderr}
+	if logFile != nil {
+		lw := &logDirWriter{ctx: ctx, f: logFile}
+		stdout = append(stdout, lw)
+		stderr = append(stderr, lw)
+	}
+	var tags []*tagWriter
+	if opts.framed {
+		rn.framed = &limitWriter{
+			limit:    int(*flagOutputLimit),
+			keepTail: *flagTruncateTail,
+			buf:      new(bytes.Buffer),
+		}
+		tags = []*tagWriter{
+			{tag: "stdout: ", w: rn.framed},
+			{tag: "stderr: ", w: rn.framed},
+		}
+		stdout = append(stdout, tags[0])
+		stderr = append(stderr, tags[1])
+	}
+	if opts.jsonl {
+		rn.events = newEvents()
+		stdout = append(stdout, rn.events.writer("stdout"))
+		stderr = append(stderr, rn.events.writer("stderr"))
+	}
+	var activity *activityWriter
+	if *flagIdleKill > 0 {
+		activity = newActivityWriter()
+		stdout = append(stdout, activity)
+		stderr = append(stderr, activity)
+	}
+	cmd.Stdout = io.MultiWriter(stdout...)
+	cmd.Stderr = io.MultiWriter(stderr...)
+	// childrenMu is held until the child is recorded, so that no other child
+	// can be started in between the check against -max-concurrent.
+	childrenMu.Lock()
+	// fail undoes what was done so far, when the command is not started.
+	fail := func(err error) (*run, error) {
+		childrenMu.Unlock()
+		cancel()
+		if logFile != nil {
+			logFile.Close()
+			os.Remove(logFile.Name())
+		}
+		return nil, err
+	}
+	if draining {
+		return fail(errDraining)
+	}
+	if *flagMaxConcurrent > 0 && len(children) >= *flagMaxConcurrent {
+		return fail(errTooManyChildren)
+	}
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		var err error
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		metricFailedRuns.Inc()
+		logf(ctx, "%v failed to start: %v, %v", args[0], err, rn.stderr.String())
+		if stderr := rn.stderr.String(); stderr != "" {
+			return fail(fmt.Errorf("%v\n%v", err, stderr))
+		}
+		return fail(err)
+	}
+	metricRuns.Inc()
+	logf(ctx, "Started %v with pid %v", args[0], cmd.Process.Pid)
+	if *flagNice != 0 {
+		if err := setNice(cmd.Process.Pid, *flagNice); err != nil {
+			logf(ctx, "could not set the niceness of %v: %v", cmd.Process.Pid, err)
+		} else {
+			logf(ctx, "set the niceness of %v to %d", cmd.Process.Pid, *flagNice)
+		}
+	}
+	rn.start = time.Now()
+	if activity != nil {
+		go killWhenIdle(rn, args[0], activity, *flagIdleKill)
+	}
+	c := &child{
+		pid:       cmd.Process.Pid,
+		start:     rn.start,
+		name:      opts.name,
+		args:      args,
+		process:   cmd.Process,
+		stdout:    rn.stdout,
+		exited:    rn.exited,
+		requestID: opts.requestID,
+	}
+	children[c.pid] = c
+	childrenMu.Unlock()
+	if stdinPipe != nil {
+		// All the writes to stdin have to be done before calling Wait.
+		if _, err := io.Copy(stdinPipe, stdin); err != nil {
+			logf(ctx, "could not write to stdin of %v: %v", args[0], err)
+		}
+		if err := stdinPipe.Close(); err != nil {
+			logf(ctx, "could not close stdin of %v: %v", args[0], err)
+		}
+	}
+	go func() {
+		rn.err = cmd.Wait()
+		for _, t := range tags {
+			// limitWriter writes do not fail.
+			t.flush()
+		}
+		if logFile != nil {
+			if err := logFile.Close(); err != nil {
+				logf(ctx, "could not close %v: %v", logFile.Name(), err)
+			}
+		}
+		if rn.timedOut() {
+			logf(ctx, "%v timed out after %v", args[0], timeout)
+		}
+		cancel()
+		if rn.err != nil {
+			metricFailedRuns.Inc()
+			logf(ctx, "%v failed: %v, %v", args[0], rn.err, rn.stderr.String())
+		}
+		childrenMu.Lock()
+		// After a SIGKILL to all the children, the pid might already have
+		// been reused by a newer child.
+		if children[c.pid] == c {
+			delete(children, c.pid)
+		}
+		childrenMu.Unlock()
+		end := time.Now()
+		rn.end = end
+		addExit(end, exitCode(rn.err))
+		if *flagHistory > 0 {
+			addToHistory(record{
+				Args:      args,
+				Start:     rn.start,
+				End:       end,
+				ExitCode:  exitCode(rn.err),
+				Truncated: rn.output.truncated(),
+				Output:    rn.output.buf.String(),
+			})
+		}
+		close(rn.exited)
+		if rn.callback != "" {
+			sendCallback(rn)
+		}
+	}()
+	return rn, nil
+}
+
+// logDirWriter writes to f, the -log-dir file of a run. Since f is only a
+// record of the output, the first error writing to it is logged, and the
+// writes that follow are dropped, instead of failing the writes of the
+// command, and thus its other outputs.
+type logDirWriter struct {
+	ctx context.Context
+	f   *os.File
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func (lw *logDirWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.failed {
+		return len(p), nil
+	}
+	if _, err := lw.f.Write(p); err != nil {
+		logf(lw.ctx, "could not write to %v, and will not anymore: %v", lw.f.Name(), err)
+		lw.failed = true
+	}
+	return len(p), nil
+}
+
+// createLogFile creates, in -log-dir, the file where the output of the run
+// described by opts is written.
+func createLogFile(opts *runOptions) (*os.File, error) {
+	name := opts.logName
+	if name == "" {
+		name = filepath.Base(opts.args[0])
+	}
+	name = fmt.Sprintf("%s-%s.log", name, time.Now().Format("20060102T150405.000000000"))
+	return os.OpenFile(filepath.Join(*flagLogDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startSleep spawns a command that runs until it is killed, and kills it at
+// the end of the test.
+func startSleep(t *testing.T) *run {
+	t.Helper()
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep command")
+	}
+	rn, err := spawn(&runOptions{name: "sleeper", args: []string{"sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		signalGroup(rn.cmd.Process, os.Kill)
+		<-rn.exited
+	})
+	return rn
+}
+
+// waitExited waits for rn to exit.
+func waitExited(t *testing.T, rn *run) {
+	t.Helper()
+	select {
+	case <-rn.exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("command did not exit")
+	}
+}
+
+func TestSpawnChildren(t *testing.T) {
+	rn := startSleep(t)
+	pid := rn.cmd.Process.Pid
+	childrenMu.RLock()
+	c, ok := children[pid]
+	childrenMu.RUnlock()
+	if !ok {
+		t.Fatalf("child %d not recorded", pid)
+	}
+	if c.name != "sleeper" || len(c.args) != 2 || c.args[0] != "sleep" {
+		t.Errorf("got child %q %q, want sleeper [sleep 60]", c.name, c.args)
+	}
+	if rn.done() {
+		t.Error("done while still running")
+	}
+	if err := signalGroup(rn.cmd.Process, os.Kill); err != nil {
+		t.Fatal(err)
+	}
+	waitExited(t, rn)
+	childrenMu.RLock()
+	_, ok = children[pid]
+	childrenMu.RUnlock()
+	if ok {
+		t.Errorf("child %d still recorded after exiting", pid)
+	}
+	if code := exitCode(rn.err); code != -1 {
+		t.Errorf("got exit code %d for a killed child, want -1", code)
+	}
+}
+
+func TestSpawnExitCode(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh command")
+	}
+	rn, err := spawn(&runOptions{args: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitExited(t, rn)
+	if code := exitCode(rn.err); code != 3 {
+		t.Errorf("got exit code %d, want 3", code)
+	}
+	if got := rn.stdout.buf.String(); got != "out\n" {
+		t.Errorf("got stdout %q, want %q", got, "out\n")
+	}
+	if got := rn.stderr.String(); got != "err\n" {
+		t.Errorf("got stderr %q, want %q", got, "err\n")
+	}
+	childrenMu.RLock()
+	_, ok := children[rn.cmd.Process.Pid]
+	childrenMu.RUnlock()
+	if ok {
+		t.Error("child still recorded after exiting")
+	}
+}
+
+func TestSpawnMaxConcurrent(t *testing.T) {
+	defer func(n int) { *flagMaxConcurrent = n }(*flagMaxConcurrent)
+	*flagMaxConcurrent = 1
+	startSleep(t)
+	if _, err := spawn(&runOptions{args: []string{"sleep", "60"}}); err != errTooManyChildren {
+		t.Errorf("got error %v, want %v", err, errTooManyChildren)
+	}
+}
+
+func TestSpawnDraining(t *testing.T) {
+	childrenMu.Lock()
+	draining = true
+	childrenMu.Unlock()
+	defer func() {
+		childrenMu.Lock()
+		draining = false
+		childrenMu.Unlock()
+	}()
+	if _, err := spawn(&runOptions{args: []string{"sleep", "60"}}); err != errDraining {
+		t.Errorf("got error %v, want %v", err, errDraining)
+	}
+}
+
+func TestLogDirWriterError(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "run.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw := &logDirWriter{ctx: context.Background(), f: f}
+	var other bytes.Buffer
+	w := io.MultiWriter(lw, &other)
+	if _, err := io.WriteString(w, "before\n"); err != nil {
+		t.Fatal(err)
+	}
+	// Any further write to f fails.
+	f.Close()
+	for _, s := range []string{"after\n", "again\n"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Errorf("error after the log file failed: %v", err)
+		}
+	}
+	if got, want := other.String(), "before\nafter\nagain\n"; got != want {
+		t.Errorf("got %q in the other writer, want %q", got, want)
+	}
+	if !lw.failed {
+		t.Error("failure not recorded")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// minBackoff is how long the supervisor waits before restarting a command
+	// that exited. It is doubled after each exit, up to maxBackoff.
+	minBackoff = time.Second
+	// maxBackoff is the longest the supervisor waits before a restart. A
+	// command that ran for longer than that is restarted after minBackoff
+	// again.
+	maxBackoff = time.Minute
+)
+
+// supervisorStatus is what is reported about the supervised command.
+type supervisorStatus struct {
+	Pid          int `json:"pid"` // 0 when not running
+	Restarts     int `json:"restarts"`
+	LastExitCode int `json:"last_exit_code"` // -1 if it has never exited
+}
+
+var (
+	supervisorMu sync.Mutex
+	// supervisor is nil unless -supervise.
+	supervisor *supervisorStatus
+	// supervisorStopped is set by stopSupervising.
+	supervisorStopped bool
+)
+
+// supervise runs args, and starts them again, with an exponential backoff,
+// whenever they exit, until stopSupervising is called.
+func supervise(args []string) {
+	supervisorMu.Lock()
+	supervisor = &supervisorStatus{LastExitCode: -1}
+	supervisorMu.Unlock()
+	backoff := minBackoff
+	for {
+		supervisorMu.Lock()
+		if supervisorStopped {
+			supervisorMu.Unlock()
+			return
+		}
+		supervisorMu.Unlock()
+		ran := runSupervised(args)
+		if ran > maxBackoff {
+			backoff = minBackoff
+		}
+		log.Printf("restarting %v in %v", args[0], backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		supervisorMu.Lock()
+		if !supervisorStopped {
+			supervisor.Restarts++
+		}
+		supervisorMu.Unlock()
+	}
+}
+
+// runSupervised runs args until they exit, and returns for how long they ran.
+func runSupervised(args []string) time.Duration {
+	rn, err := spawn(&runOptions{
+		args: args,
+		env:  *flagEnv,
+	})
+	if err != nil {
+		log.Printf("%v failed to start: %v", args[0], err)
+		return 0
+	}
+	supervisorMu.Lock()
+	supervisor.Pid = rn.cmd.Process.Pid
+	supervisorMu.Unlock()
+	// Nobody reads the output, except for /tail, so it is discarded as it
+	// comes, rather than kept up to -output-limit.
+	for done := false; !done; {
+		select {
+		case <-rn.exited:
+			done = true
+		case <-time.After(time.Second):
+		}
+		if _, err := io.Copy(ioutil.Discard, rn.stdout); err != nil {
+			log.Printf("output copy error: %v", err)
+		}
+	}
+	supervisorMu.Lock()
+	supervisor.Pid = 0
+	supervisor.LastExitCode = exitCode(rn.err)
+	supervisorMu.Unlock()
+	return rn.end.Sub(rn.start)
+}
+
+// stopSupervising prevents the supervised command from being restarted.
+func stopSupervising() {
+	supervisorMu.Lock()
+	defer supervisorMu.Unlock()
+	supervisorStopped = true
+}
+
+// supervisorState returns a copy of the status of the supervised command, or
+// nil unless -supervise.
+func supervisorState() *supervisorStatus {
+	supervisorMu.Lock()
+	defer supervisorMu.Unlock()
+	if supervisor == nil {
+		return nil
+	}
+	s := *supervisor
+	return &s
+}
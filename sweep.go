@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// sweepInterval is how often sweepChildren looks for children that no longer
+// exist.
+const sweepInterval = time.Minute
+
+// sweepStop is closed to stop sweepChildren.
+var sweepStop = make(chan struct{})
+
+// sweepChildren periodically removes from children the entries of the
+// processes that no longer exist, e.g. if the wait for them failed, until
+// sweepStop is closed.
+func sweepChildren() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sweepStop:
+			return
+		case <-ticker.C:
+		}
+		childrenMu.Lock()
+		for pid, c := range children {
+			if !processExists(c.process) {
+				log.Printf("%d no longer exists, forgetting it", pid)
+				delete(children, pid)
+			}
+		}
+		childrenMu.Unlock()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// handleTail streams the output of the child with the given pid, starting
+// with what has not been sent in the response to /run yet, until the child
+// exits.
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pid %q", r.FormValue("pid")), http.StatusBadRequest)
+		return
+	}
+	childrenMu.RLock()
+	c, ok := children[pid]
+	childrenMu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no child with pid %d", pid), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	t := c.stdout.tail()
+	defer c.stdout.untail(t)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := streamOutput(r.Context(), throttle(r.Context(), w), flusher, t, c.exited); err != nil {
+		logf(r.Context(), "client for the output of %d went away", pid)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// placeholderRE matches a placeholder, such as {{.Name}}.
+var placeholderRE = regexp.MustCompile(`\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// allowedPlaceholder reports whether name is one of -placeholders.
+func allowedPlaceholder(name string) bool {
+	for _, allowed := range strings.Split(*flagPlaceholders, ",") {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholders returns the names of the placeholders, such as {{.Name}}, in
+// word. Only the names of -placeholders make placeholders, anything else,
+// such as {{.Names}} in a docker --format, is kept as is.
+func placeholders(word string) []string {
+	if *flagPlaceholders == "" {
+		return nil
+	}
+	var names []string
+	for _, m := range placeholderRE.FindAllStringSubmatch(word, -1) {
+		if allowedPlaceholder(m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// checkTemplates returns an error if the program, args[0], is a template.
+func checkTemplates(args []string) error {
+	if len(args) > 0 && len(placeholders(args[0])) > 0 {
+		return fmt.Errorf("the program %q can't be a template", args[0])
+	}
+	return nil
+}
+
+// checkPlaceholderValues returns an error if any value, returned by param, of
+// the placeholders in args does not match -arg-allow, since they come from the
+// request like the args parameter.
+func checkPlaceholderValues(args []string, param func(name string) (string, bool)) error {
+	if argAllow == nil {
+		return nil
+	}
+	for _, word := range args {
+		for _, name := range placeholders(word) {
+			if v, ok := param(name); ok && !argAllow.MatchString(v) {
+				return fmt.Errorf("value %q of %v not allowed", v, name)
+			}
+		}
+	}
+	return nil
+}
+
+// expandArgs returns args, with the placeholders replaced by their value, as
+// returned by param. All the placeholders must have a value. Since the words
+// are not interpreted by a shell, the values need no escaping, and each of
+// them stays in the word where its placeholder is.
+func expandArgs(args []string, param func(name string) (string, bool)) ([]string, error) {
+	var expanded []string
+	for _, word := range args {
+		names := placeholders(word)
+		if len(names) == 0 {
+			expanded = append(expanded, word)
+			continue
+		}
+		values := make(map[string]string)
+		for _, name := range names {
+			v, ok := param(name)
+			if !ok {
+				return nil, fmt.Errorf("missing parameter %q", name)
+			}
+			if strings.ContainsRune(v, 0) {
+				return nil, fmt.Errorf("invalid parameter %q", name)
+			}
+			values[name] = v
+		}
+		expanded = append(expanded, placeholderRE.ReplaceAllStringFunc(word, func(m string) string {
+			name := placeholderRE.FindStringSubmatch(m)[1]
+			if v, ok := values[name]; ok {
+				return v
+			}
+			return m
+		}))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"net/http"
+	"time"
+)
+
+//go:embed ui.html
+var uiFS embed.FS
+
+// handleUI serves a web page to run, list, and kill the children, and to
+// view their output.
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	page, err := uiFS.ReadFile("ui.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "ui.html", time.Time{}, bytes.NewReader(page))
+}